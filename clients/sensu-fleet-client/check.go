@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -28,6 +29,8 @@ const (
 	DefaultClusterSizeErrorThreshold   float64 = 8.0
 	overloadCoef                       float32 = 1.3
 	rescheduleBlacklist                string  = "rabbit|elasticsearch|fleet-ship|healthcheck"
+	DefaultRebalanceMaxUnits           float64 = 1.0
+	DefaultRebalanceCooldown           float64 = 1800.0
 )
 
 func EtcdNamespace() string {
@@ -63,16 +66,7 @@ func NewEtcdClient() *etcd.Client {
 
 func MachinesMetric() check.ExtensionCheckResult {
 	metric := handler.Metric{}
-	fleetClient, err := NewFleetClient()
-	etcdClient := NewEtcdClient()
-
-	if err != nil {
-		log.Println(err.Error())
-
-		return metric.Render()
-	}
-
-	machines, err := fleetClient.Machines()
+	snapshot, err := snapshots.get()
 
 	if err != nil {
 		log.Println(err.Error())
@@ -82,7 +76,7 @@ func MachinesMetric() check.ExtensionCheckResult {
 
 	results := make(map[string]uint)
 
-	for _, m := range machines {
+	for _, m := range snapshot.machines {
 		results["machines.all.all"]++
 		roles := []string{"all"}
 
@@ -91,15 +85,11 @@ func MachinesMetric() check.ExtensionCheckResult {
 			roles = append(roles, r)
 		}
 
-		if r, err := etcdClient.Get(
-			fmt.Sprintf("/%s/%s/version", EtcdNamespace(), m.ID),
-			false,
-			false,
-		); err != nil {
-			log.Println(err.Error())
+		if version, ok := snapshot.infos[m.ID]["version"]; !ok {
+			log.Printf("%s: no version registered", m.ID)
 		} else {
 			for _, role := range roles {
-				results[fmt.Sprintf("machines.%s.%s", role, r.Node.Value)]++
+				results[fmt.Sprintf("machines.%s.%s", role, version)]++
 			}
 		}
 	}
@@ -112,90 +102,43 @@ func MachinesMetric() check.ExtensionCheckResult {
 }
 
 func ClusterSize() (float64, error) {
-	fleetClient, err := NewFleetClient()
-
-	if err != nil {
-		return 0.0, err
-	}
-
-	machines, err := fleetClient.Machines()
+	snapshot, err := snapshots.get()
 
 	if err != nil {
 		return 0.0, err
 	}
 
-	return float64(len(machines)), nil
+	return float64(len(snapshot.machines)), nil
 }
 
-func UnitBalancingCheck() check.ExtensionCheckResult {
-	cl, err := NewFleetClient()
-
-	if err != nil {
-		return handler.Error(err.Error())
-	}
-
-	machines, err := cl.Machines()
-
-	if err != nil {
-		return handler.Error(err.Error())
-	}
-
-	machinesByRoles := make(map[string][]string)
-
-	for _, machine := range machines {
-		machinesByRoles[machine.Metadata["role"]] = append(
-			machinesByRoles[machine.Metadata["role"]],
-			machine.ID,
-		)
-	}
-
-	units, err := cl.Units()
-
-	if err != nil {
-		return handler.Error(err.Error())
-	}
-
-	unitsByMachines := make(map[string][]string)
-
-	for _, unit := range units {
-		unitsByMachines[unit.MachineID] = append(
-			unitsByMachines[unit.MachineID],
-			unit.Name,
-		)
-	}
-
-	overloadedMachines := make(map[string]int)
+// unitsToRebalance picks, among the units of the machines overloaded
+// compared to the other machines of their role, the ones to reschedule.
+func unitsToRebalance(load *clusterLoad, policy *rebalancingPolicy) []string {
+	overloadedMachines := make(map[string]float32)
 
-	for _, machines := range machinesByRoles {
-		totalJobs := 0
+	for role, machines := range load.machinesByRoles {
+		average := load.average(role)
 
 		for _, id := range machines {
-			totalJobs += len(unitsByMachines[id])
-		}
+			deltaLoad := float32(int(load.loads[id]/policy.coefficient - average))
 
-		for _, id := range machines {
-			deltaUnits := int(
-				float32(len(unitsByMachines[id]))/overloadCoef - float32(totalJobs)/float32(len(machines)),
-			)
-
-			if deltaUnits >= 1 {
-				overloadedMachines[id] = deltaUnits
+			if deltaLoad >= 1 {
+				overloadedMachines[id] = deltaLoad
 			}
 		}
 	}
 
 	pickedUnits := []string{}
-	blacklistUnits := regexp.MustCompile(rescheduleBlacklist)
 
 	for id, total := range overloadedMachines {
-		picked := 0
+		picked := float32(0.0)
 
-		for _, unit := range unitsByMachines[id] {
+		for _, unit := range load.unitsByMachines[id] {
 			if picked >= total {
 				break
 			}
 
-			if !blacklistUnits.Match([]byte(unit)) {
+			if !policy.blacklist.MatchString(unit) {
 				selectable := true
 
 				for _, curUnit := range pickedUnits {
@@ -206,32 +149,122 @@ func UnitBalancingCheck() check.ExtensionCheckResult {
 
 				if selectable {
 					pickedUnits = append(pickedUnits, unit)
-					picked++
+					picked += policy.weight(unit)
 				}
 			}
 		}
 	}
 
-	if len(pickedUnits) > 0 {
-		return handler.Error(
-			fmt.Sprintf(
-				"Units selected to be rebalanced: %s",
-				strings.Join(pickedUnits, ","),
-			),
-		)
-	} else {
-		return handler.Ok("Cluster well balanced")
+	return pickedUnits
+}
+
+func roleName(role string) string {
+	if role == "" {
+		return "none"
 	}
+
+	return role
 }
 
-func UnitsCheck() check.ExtensionCheckResult {
-	cl, err := NewFleetClient()
+func UnitBalancingMetric() check.ExtensionCheckResult {
+	metric := handler.Metric{}
+	_, etcdClient, err := snapshots.clients()
+
+	if err != nil {
+		log.Println(err.Error())
+
+		return metric.Render()
+	}
+
+	snapshot, err := snapshots.get()
+
+	if err != nil {
+		log.Println(err.Error())
+
+		return metric.Render()
+	}
+
+	policy, err := loadRebalancingPolicy(etcdClient)
+
+	if err != nil {
+		log.Println(err.Error())
+
+		return metric.Render()
+	}
+
+	load := newClusterLoad(snapshot, policy)
+
+	for role := range load.machinesByRoles {
+		for name, v := range map[string]float32{
+			"imbalance":    load.imbalance(role),
+			"average_load": load.average(role),
+			"max_load":     load.max(role),
+		} {
+			metric.AddPoint(
+				&handler.Point{
+					fmt.Sprintf("fleet.balancing.%s.%s", roleName(role), name),
+					float64(v),
+				},
+			)
+		}
+	}
+
+	return metric.Render()
+}
+
+func UnitBalancingCheck() check.ExtensionCheckResult {
+	s, etcdClient, err := snapshots.clients()
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	snapshot, err := snapshots.get()
 
 	if err != nil {
 		return handler.Error(err.Error())
 	}
 
-	units, err := cl.Units()
+	policy, err := loadRebalancingPolicy(etcdClient)
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	load := newClusterLoad(snapshot, policy)
+
+	pickedUnits := unitsToRebalance(load, policy)
+
+	if len(pickedUnits) > 0 {
+		message := fmt.Sprintf(
+			"Units selected to be rebalanced: %s",
+			strings.Join(pickedUnits, ","),
+		)
+
+		if os.Getenv("REBALANCE_ENABLED") == "true" {
+			if fleet, ok := s.(*fleetScheduler); ok {
+				message = fmt.Sprintf(
+					"%s, %s",
+					message,
+					Rebalance(fleet.API, etcdClient, pickedUnits),
+				)
+				snapshots.invalidate()
+			} else {
+				message = fmt.Sprintf(
+					"%s, rebalancing requires the fleet scheduler",
+					message,
+				)
+			}
+		}
+
+		return handler.Error(message)
+	} else {
+		return handler.Ok("Cluster well balanced")
+	}
+}
+
+func UnitsCheck() check.ExtensionCheckResult {
+	snapshot, err := snapshots.get()
 
 	if err != nil {
 		return handler.Error(err.Error())
@@ -239,7 +272,7 @@ func UnitsCheck() check.ExtensionCheckResult {
 
 	wrongStates := []string{}
 
-	for _, u := range units {
+	for _, u := range snapshot.units {
 		if u.DesiredState != u.CurrentState || u.DesiredState == "inactive" {
 			ju := job.Unit{Unit: *schema.MapSchemaUnitOptionsToUnitFile(u.Options)}
 
@@ -261,74 +294,102 @@ func UnitsCheck() check.ExtensionCheckResult {
 	}
 }
 
-func MachineCheck() check.ExtensionCheckResult {
-	etcdClient := NewEtcdClient()
+// machineInfos are the keys of a machine kept up to date by export_infos.sh
+var machineInfos = []string{"hostname", "version"}
 
-	fleetClient, err := NewFleetClient()
-	if err != nil {
-		return handler.Error(err.Error())
-	}
+func formatMachines(title string, machines []string) string {
+	sort.Strings(machines)
+
+	return fmt.Sprintf("%s: %s", title, strings.Join(machines, ","))
+}
 
-	machines, err := fleetClient.Machines()
+// MachineCheck compares the machines known by fleet to the ones registered in
+// the namespace by export_infos.sh. It reports the registered machines missing
+// from fleet, the fleet machines which never registered, and the ones whose
+// infos expired without being refreshed.
+func MachineCheck() check.ExtensionCheckResult {
+	snapshot, err := snapshots.get()
 	if err != nil {
 		return handler.Error(err.Error())
 	}
 
-	machineIDs := []string{}
-	for _, m := range machines {
-		machineIDs = append(machineIDs, m.ID)
-	}
+	registered := make(map[string]map[string]string)
 
-	r, err := etcdClient.Get("/machines", false, false)
-	if err != nil {
-		return handler.Error(err.Error())
+	for id, infos := range snapshot.infos {
+		registered[id] = infos
 	}
 
-	missingIDs := []string{}
+	var missing, unregistered, stale []string
 
-	for _, n := range r.Node.Nodes {
-		keySlices := strings.Split(n.Key, "/")
-		id := keySlices[len(keySlices)-1]
+	for _, m := range snapshot.machines {
+		infos, ok := registered[m.ID]
+		delete(registered, m.ID)
 
-		found := false
-		for _, mid := range machineIDs {
-			if id == mid {
-				found = true
-			}
+		if !ok {
+			unregistered = append(
+				unregistered,
+				fmt.Sprintf("%s (%s)", m.ID, m.PublicIP),
+			)
+			continue
 		}
 
-		if found {
-			continue
+		expired := []string{}
+
+		for _, key := range machineInfos {
+			if _, ok := infos[key]; !ok {
+				expired = append(expired, key)
+			}
 		}
 
-		h, err := etcdClient.Get(
-			fmt.Sprintf("/machines/%s/hostname", id),
-			false,
-			false,
-		)
+		if len(expired) > 0 {
+			stale = append(
+				stale,
+				fmt.Sprintf(
+					"%s (no %s)",
+					snapshot.machineName(m.ID),
+					strings.Join(expired, ","),
+				),
+			)
+		}
+	}
 
-		if err == nil {
-			missingIDs = append(missingIDs, h.Node.Value)
+	// The remaining machines are unknown to fleet, the ones without hostname
+	// have expired and are left apart
+	for _, infos := range registered {
+		if h, ok := infos["hostname"]; ok {
+			missing = append(missing, h)
 		}
 	}
 
-	if len(missingIDs) > 0 {
-		return handler.Error(
-			fmt.Sprintf("Misssing nodes: %s", strings.Join(missingIDs, ",")),
+	messages := []string{}
+
+	if len(missing) > 0 {
+		messages = append(messages, formatMachines("Missing nodes", missing))
+	}
+
+	if len(unregistered) > 0 {
+		messages = append(
+			messages,
+			formatMachines("Unregistered nodes", unregistered),
 		)
-	} else {
-		return handler.Ok("Every nodes are up and running")
 	}
-}
 
-func UnitsStatesCheck() check.ExtensionCheckResult {
-	cl, err := NewFleetClient()
+	if len(stale) > 0 {
+		messages = append(messages, formatMachines("Stale nodes", stale))
+	}
 
-	if err != nil {
-		return handler.Error(err.Error())
+	switch {
+	case len(missing) > 0:
+		return handler.Error(strings.Join(messages, "; "))
+	case len(unregistered)+len(stale) > 0:
+		return handler.Warning(strings.Join(messages, "; "))
+	default:
+		return handler.Ok("Every nodes are up and running")
 	}
+}
 
-	units, err := cl.UnitStates()
+func UnitsStatesCheck() check.ExtensionCheckResult {
+	snapshot, err := snapshots.get()
 
 	if err != nil {
 		return handler.Error(err.Error())
@@ -348,7 +409,7 @@ func UnitsStatesCheck() check.ExtensionCheckResult {
 
 	wrongStates := []string{}
 
-	for _, u := range units {
+	for _, u := range snapshot.states {
 		if reg.MatchString(u.Name) {
 			continue
 		}
@@ -376,8 +437,7 @@ func UnitsStatesCheck() check.ExtensionCheckResult {
 
 func UnitsMetric() check.ExtensionCheckResult {
 	metric := handler.Metric{}
-	fleetClient, err := NewFleetClient()
-	etcdClient := NewEtcdClient()
+	snapshot, err := snapshots.get()
 
 	if err != nil {
 		log.Println(err.Error())
@@ -385,32 +445,49 @@ func UnitsMetric() check.ExtensionCheckResult {
 		return metric.Render()
 	}
 
-	units, err := fleetClient.UnitStates()
-
-	if err != nil {
-		log.Println(err.Error())
+	roles := make(map[string]string)
 
-		return metric.Render()
+	for _, m := range snapshot.machines {
+		roles[m.ID] = roleName(m.Metadata["role"])
 	}
 
 	results := make(map[string]uint)
 
-	for _, u := range units {
+	for _, u := range snapshot.states {
 		results["units.global.total"]++
 		results[fmt.Sprintf("units.global.%s", u.SystemdSubState)]++
 
-		if r, err := etcdClient.Get(
-			fmt.Sprintf("/%s/%s/hostname", EtcdNamespace(), u.MachineID),
-			false,
-			false,
-		); err != nil {
-			log.Println(err.Error())
+		if hostname, ok := snapshot.hostname(u.MachineID); !ok {
+			log.Printf("%s: no hostname registered", u.MachineID)
 		} else {
-			results[fmt.Sprintf("units.%s.%s", r.Node.Value, u.SystemdSubState)]++
-			results[fmt.Sprintf("units.%s.total", r.Node.Value)]++
+			results[fmt.Sprintf("units.%s.%s", hostname, u.SystemdSubState)]++
+			results[fmt.Sprintf("units.%s.total", hostname)]++
+		}
+
+		if template := templateUnit(u.Name); template != "" {
+			// foo@.service is graphed as units.templates.foo.service
+			template = strings.Replace(template, "@.", ".", 1)
+			results[fmt.Sprintf("units.templates.%s.%s", template, u.SystemdSubState)]++
+			results[fmt.Sprintf("units.templates.%s.total", template)]++
+		}
+
+		if role, ok := roles[u.MachineID]; ok {
+			results[fmt.Sprintf("units.roles.%s.%s", role, u.SystemdSubState)]++
+			results[fmt.Sprintf("units.roles.%s.total", role)]++
 		}
 	}
 
+	results["units.mismatch.total"] = 0
+
+	for _, u := range snapshot.units {
+		if u.DesiredState == u.CurrentState {
+			continue
+		}
+
+		results["units.mismatch.total"]++
+		results[fmt.Sprintf("units.mismatch.%s.%s", u.DesiredState, u.CurrentState)]++
+	}
+
 	for k, v := range results {
 		metric.AddPoint(&handler.Point{k, float64(v)})
 	}
@@ -418,20 +495,35 @@ func UnitsMetric() check.ExtensionCheckResult {
 	return metric.Render()
 }
 
-func main() {
-	cfg := sensu.NewConfigFromFlagSet(sensu.ExtractFlags())
-
-	t := rabbitmq.NewRabbitMQTransport(cfg.RabbitMQURI())
-	client := sensu.NewClient(t, cfg)
+// registerStandardCheck registers a StandardCheck as <name>-check and its
+// value as <name>-metric.
+func registerStandardCheck(name string, c *utils.StandardCheck) {
+	check.Store[fmt.Sprintf("%s-check", name)] = &check.ExtensionCheck{c.Check}
+	check.Store[fmt.Sprintf("%s-metric", name)] = &check.ExtensionCheck{c.Metric}
+}
 
+// registerChecks fills check.Store with every fleet check and metric.
+func registerChecks() {
 	check.Store["fleet-units-metrics"] = &check.ExtensionCheck{UnitsMetric}
 	check.Store["fleet-cluster-balancing"] = &check.ExtensionCheck{UnitBalancingCheck}
+	check.Store["fleet-cluster-balancing-metric"] = &check.ExtensionCheck{
+		UnitBalancingMetric,
+	}
 	check.Store["fleet-machines-metrics"] = &check.ExtensionCheck{MachinesMetric}
 	check.Store["fleet-machines-check"] = &check.ExtensionCheck{MachineCheck}
 	check.Store["fleet-unit-states-checks"] = &check.ExtensionCheck{
 		UnitsStatesCheck,
 	}
 	check.Store["fleet-units-checks"] = &check.ExtensionCheck{UnitsCheck}
+	check.Store["fleet-units-flapping-check"] = &check.ExtensionCheck{
+		UnitsFlappingCheck,
+	}
+	check.Store["fleet-global-units-check"] = &check.ExtensionCheck{
+		GlobalUnitsCheck,
+	}
+	check.Store["fleet-templates-drift-check"] = &check.ExtensionCheck{
+		TemplatesDriftCheck,
+	}
 
 	clusterCheck := utils.StandardCheck{
 		ErrorThreshold: utils.EnvironmentValueOrConst(
@@ -450,12 +542,16 @@ func main() {
 		Comp: func(x, y float64) bool { return x > y },
 	}
 
-	check.Store["fleet-cluster-size-check"] = &check.ExtensionCheck{
-		clusterCheck.Check,
-	}
-	check.Store["fleet-cluster-size-metric"] = &check.ExtensionCheck{
-		clusterCheck.Check,
-	}
+	registerStandardCheck("fleet-cluster-size", &clusterCheck)
+}
+
+func main() {
+	cfg := sensu.NewConfigFromFlagSet(sensu.ExtractFlags())
+
+	t := rabbitmq.NewRabbitMQTransport(cfg.RabbitMQURI())
+	client := sensu.NewClient(t, cfg)
+
+	registerChecks()
 
 	client.Start()
 }
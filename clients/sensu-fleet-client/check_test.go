@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/schema"
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/upfluence/sensu-client-go/sensu/check"
+)
+
+// fakeScheduler serves a fixed cluster state.
+type fakeScheduler struct {
+	machines []machine.MachineState
+	units    []*schema.Unit
+	states   []*schema.UnitState
+}
+
+func (s *fakeScheduler) Machines(etcd.Nodes) ([]machine.MachineState, error) {
+	return s.machines, nil
+}
+
+func (s *fakeScheduler) Units() ([]*schema.Unit, error) {
+	return s.units, nil
+}
+
+func (s *fakeScheduler) UnitStates(etcd.Nodes) ([]*schema.UnitState, error) {
+	return s.states, nil
+}
+
+var testScheduler = &fakeScheduler{
+	machines: []machine.MachineState{
+		{ID: "m1", Metadata: map[string]string{"role": "api"}},
+		{ID: "m2", Metadata: map[string]string{"role": "api"}},
+	},
+	units: []*schema.Unit{
+		{
+			Name:         "api@1.service",
+			MachineID:    "m1",
+			DesiredState: "launched",
+			CurrentState: "launched",
+		},
+		{
+			Name:         "api@2.service",
+			MachineID:    "m1",
+			DesiredState: "launched",
+			CurrentState: "loaded",
+		},
+	},
+	states: []*schema.UnitState{
+		{Name: "api@1.service", MachineID: "m1", SystemdSubState: "running"},
+		{Name: "api@2.service", MachineID: "m1", SystemdSubState: "dead"},
+	},
+}
+
+// stubSnapshots makes the checks read testScheduler, through an etcd where no
+// key is set.
+func stubSnapshots() func() {
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Etcd-Index", "1")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(
+				[]byte(
+					`{"errorCode":100,"message":"Key not found","cause":"/","index":1}`,
+				),
+			)
+		}),
+	)
+
+	snapshots.scheduler = testScheduler
+	snapshots.etcdClient = etcd.NewClient([]string{server.URL})
+	snapshots.snapshot = &registrySnapshot{
+		machines: testScheduler.machines,
+		units:    testScheduler.units,
+		states:   testScheduler.states,
+		infos: map[string]map[string]string{
+			"m1": {"hostname": "core-1", "version": "1068.6.0"},
+			"m2": {"hostname": "core-2", "version": "1068.6.0"},
+		},
+		fetchedAt: time.Now(),
+	}
+
+	return func() {
+		server.Close()
+		snapshots.scheduler = nil
+		snapshots.etcdClient = nil
+		snapshots.snapshot = nil
+	}
+}
+
+var graphiteLine = regexp.MustCompile(`^[\w.@-]+ -?\d+(\.\d+)? \d+$`)
+
+func TestMetricsRenderGraphite(t *testing.T) {
+	defer stubSnapshots()()
+
+	registerChecks()
+
+	expectedSeries := map[string][]string{
+		"fleet-units-metrics": {
+			"units.global.total",
+			"units.core-1.running",
+			"units.roles.api.total",
+			"units.templates.api.service.running",
+			"units.mismatch.launched.loaded",
+		},
+		"fleet-machines-metrics": {
+			"machines.all.all",
+			"machines.api.1068.6.0",
+		},
+		"fleet-cluster-balancing-metric": {
+			"fleet.balancing.api.imbalance",
+		},
+		"fleet-cluster-size-metric": {
+			"fleet.cluster_size",
+		},
+	}
+
+	for name := range check.Store {
+		if !strings.HasSuffix(name, "-metric") &&
+			!strings.HasSuffix(name, "-metrics") {
+			continue
+		}
+
+		if _, ok := expectedSeries[name]; !ok {
+			t.Errorf("%s: not covered", name)
+		}
+	}
+
+	for name, series := range expectedSeries {
+		c, ok := check.Store[name]
+
+		if !ok {
+			t.Errorf("%s: not registered", name)
+			continue
+		}
+
+		output := c.Execute().Output
+		rendered := make(map[string]bool)
+
+		for _, line := range strings.Split(output, "\n") {
+			if !graphiteLine.MatchString(line) {
+				t.Errorf("%s: not a graphite line: %q", name, line)
+				continue
+			}
+
+			rendered[strings.Fields(line)[0]] = true
+		}
+
+		for _, s := range series {
+			if !rendered[s] {
+				t.Errorf("%s: %s not rendered in %q", name, s, output)
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/schema"
+	"github.com/upfluence/sensu-client-go/sensu/check"
+	"github.com/upfluence/sensu-client-go/sensu/handler"
+)
+
+// GlobalUnitsCheck reports, for every global unit, the machines matching its
+// X-Fleet MachineMetadata where the unit is missing or is not running.
+func GlobalUnitsCheck() check.ExtensionCheckResult {
+	snapshot, err := snapshots.get()
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	blackListRegexp := DefaultBlacklist
+
+	if v := os.Getenv("BLACKLIST_REGEXP"); v != "" {
+		blackListRegexp = v
+	}
+
+	reg, err := regexp.Compile(blackListRegexp)
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	statesByUnits := make(map[string]map[string]*schema.UnitState)
+
+	for _, s := range snapshot.states {
+		if _, ok := statesByUnits[s.Name]; !ok {
+			statesByUnits[s.Name] = make(map[string]*schema.UnitState)
+		}
+
+		statesByUnits[s.Name][s.MachineID] = s
+	}
+
+	var missing, notRunning []string
+
+	for _, u := range snapshot.units {
+		if reg.MatchString(u.Name) || u.DesiredState == string(job.JobStateInactive) {
+			continue
+		}
+
+		j := job.Job{
+			Name: u.Name,
+			Unit: *schema.MapSchemaUnitOptionsToUnitFile(u.Options),
+		}
+		ju := job.Unit{Name: j.Name, Unit: j.Unit}
+
+		if !ju.IsGlobal() {
+			continue
+		}
+
+		required := j.RequiredTargetMetadata()
+
+		for i := range snapshot.machines {
+			m := &snapshot.machines[i]
+
+			if !machine.HasMetadata(m, required) {
+				continue
+			}
+
+			s, ok := statesByUnits[u.Name][m.ID]
+
+			switch {
+			case !ok:
+				missing = append(
+					missing,
+					fmt.Sprintf("%s (%s)", u.Name, snapshot.machineName(m.ID)),
+				)
+			case u.DesiredState == string(job.JobStateLaunched) &&
+				s.SystemdActiveState != "active":
+				notRunning = append(
+					notRunning,
+					fmt.Sprintf(
+						"%s (%s, %s)",
+						u.Name,
+						snapshot.machineName(m.ID),
+						s.SystemdSubState,
+					),
+				)
+			}
+		}
+	}
+
+	messages := []string{}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		messages = append(
+			messages,
+			fmt.Sprintf("Missing global units: %s", strings.Join(missing, ",")),
+		)
+	}
+
+	if len(notRunning) > 0 {
+		sort.Strings(notRunning)
+		messages = append(
+			messages,
+			fmt.Sprintf(
+				"Global units not running: %s",
+				strings.Join(notRunning, ","),
+			),
+		)
+	}
+
+	if len(messages) > 0 {
+		return handler.Error(strings.Join(messages, "; "))
+	}
+
+	return handler.Ok("Every global units are running on their machines")
+}
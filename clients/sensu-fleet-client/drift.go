@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/coreos/fleet/schema"
+	"github.com/coreos/fleet/unit"
+	"github.com/upfluence/sensu-client-go/sensu/check"
+	"github.com/upfluence/sensu-client-go/sensu/handler"
+)
+
+// templateDefinitions groups the instances of a template by the hash of their
+// unit file.
+type templateDefinitions map[unit.Hash][]string
+
+// majority returns the hash shared by most instances, ties are broken on the
+// hash itself so that the outliers stay the same from one run to another.
+func (d templateDefinitions) majority() unit.Hash {
+	var majority unit.Hash
+	max := 0
+
+	for hash, instances := range d {
+		if len(instances) > max ||
+			(len(instances) == max && hash.String() < majority.String()) {
+			majority = hash
+			max = len(instances)
+		}
+	}
+
+	return majority
+}
+
+func (d templateDefinitions) outliers() []string {
+	majority := d.majority()
+	outliers := []string{}
+
+	for hash, instances := range d {
+		if hash == majority {
+			continue
+		}
+
+		for _, name := range instances {
+			outliers = append(outliers, fmt.Sprintf("%s (%s)", name, hash.Short()))
+		}
+	}
+
+	sort.Strings(outliers)
+
+	return outliers
+}
+
+// TemplatesDriftCheck reports the templates whose instances do not run the
+// same unit file, for instance after an image tag bump not rolled out to
+// every instance.
+func TemplatesDriftCheck() check.ExtensionCheckResult {
+	snapshot, err := snapshots.get()
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	templates := make(map[string]templateDefinitions)
+
+	for _, u := range snapshot.units {
+		// Instances of foo@.service and foo@.timer are compared apart
+		template := templateUnit(u.Name)
+
+		if template == "" {
+			continue
+		}
+
+		hash := schema.MapSchemaUnitOptionsToUnitFile(u.Options).Hash()
+
+		if _, ok := templates[template]; !ok {
+			templates[template] = make(templateDefinitions)
+		}
+
+		templates[template][hash] = append(templates[template][hash], u.Name)
+	}
+
+	drifts := []string{}
+
+	for template, definitions := range templates {
+		if len(definitions) < 2 {
+			continue
+		}
+
+		drifts = append(
+			drifts,
+			fmt.Sprintf(
+				"%s %d definitions, outliers: %s",
+				template,
+				len(definitions),
+				strings.Join(definitions.outliers(), ","),
+			),
+		)
+	}
+
+	if len(drifts) == 0 {
+		return handler.Ok("Every template instances run the same definition")
+	}
+
+	sort.Strings(drifts)
+
+	return handler.Warning(
+		fmt.Sprintf("Templates drifting: %s", strings.Join(drifts, "; ")),
+	)
+}
@@ -4,5 +4,13 @@ machineID=`cat /etc/machine-id`
 hostname=`hostname`
 osVersion=`cat /etc/os-release | grep VERSION | head -n 1 | cut -d'=' -f2`
 
-etcdctl set /${NAMESPACE:-"machines"}/$machineID/hostname $hostname
-etcdctl set /${NAMESPACE:-"machines"}/$machineID/version $osVersion
+# With TTL set the infos expire unless refreshed, and the machine is reported
+# as stale by fleet-machines-check
+ttl=${TTL:+--ttl $TTL}
+
+etcdctl set $ttl /${NAMESPACE:-"machines"}/$machineID/hostname $hostname
+etcdctl set $ttl /${NAMESPACE:-"machines"}/$machineID/version $osVersion
+
+if [ -n "$ROLE" ]; then
+  etcdctl set $ttl /${NAMESPACE:-"machines"}/$machineID/role $ROLE
+fi
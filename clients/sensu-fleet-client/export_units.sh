@@ -0,0 +1,14 @@
+#!/bin/sh
+
+# Publishes the state of the running and failed systemd services of the
+# machine, read by sensu-fleet-client when SCHEDULER=etcd. Services never
+# started or stopped on purpose are left out.
+
+machineID=`cat /etc/machine-id`
+ttl=${TTL:+--ttl $TTL}
+
+systemctl list-units --type=service --state=active,failed --no-legend --plain |
+  while read unit load active sub description; do
+    etcdctl set $ttl /${NAMESPACE:-"machines"}/$machineID/units/$unit \
+      "$load $active $sub"
+  done
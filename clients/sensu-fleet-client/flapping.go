@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/fleet/schema"
+	"github.com/upfluence/sensu-client-go/sensu/check"
+	"github.com/upfluence/sensu-client-go/sensu/handler"
+	"github.com/upfluence/sensu-client-go/sensu/utils"
+)
+
+const (
+	DefaultFlappingThreshold float64 = 3.0
+	DefaultFlappingWindow    float64 = 3600.0
+)
+
+// unitPlacement is the part of a unit state whose changes are counted as
+// flaps.
+type unitPlacement struct {
+	subState  string
+	machineID string
+}
+
+// unitsHistory keeps, by unit, the changes of sub state or machine observed
+// between two check runs over the last window.
+type unitsHistory struct {
+	sync.Mutex
+	previous map[string]unitPlacement
+	changes  map[string][]time.Time
+}
+
+// unitKey identifies a unit state, the units running on several machines,
+// such as global units, have a state per machine followed per machine.
+func unitKey(s *schema.UnitState, shared map[string]bool) string {
+	if shared[s.Name] {
+		return fmt.Sprintf("%s@%s", s.Name, s.MachineID)
+	}
+
+	return s.Name
+}
+
+// sharedUnits lists the names of the units reported by several machines. The
+// unit files are not needed, the etcd scheduler has none.
+func sharedUnits(states []*schema.UnitState) map[string]bool {
+	machines := make(map[string]string)
+	shared := make(map[string]bool)
+
+	for _, s := range states {
+		if m, ok := machines[s.Name]; ok && m != s.MachineID {
+			shared[s.Name] = true
+		}
+
+		machines[s.Name] = s.MachineID
+	}
+
+	return shared
+}
+
+func (h *unitsHistory) record(
+	states []*schema.UnitState,
+	shared map[string]bool,
+	now time.Time,
+	window time.Duration,
+) {
+	h.Lock()
+	defer h.Unlock()
+
+	current := make(map[string]unitPlacement)
+	for _, s := range states {
+		key := unitKey(s, shared)
+		p := unitPlacement{subState: s.SystemdSubState, machineID: s.MachineID}
+		current[key] = p
+
+		if previous, ok := h.previous[key]; ok && previous != p {
+			h.changes[key] = append(h.changes[key], now)
+		}
+	}
+
+	for name, changes := range h.changes {
+		recent := []time.Time{}
+
+		for _, t := range changes {
+			if now.Sub(t) < window {
+				recent = append(recent, t)
+			}
+		}
+
+		if len(recent) == 0 {
+			delete(h.changes, name)
+		} else {
+			h.changes[name] = recent
+		}
+	}
+
+	h.previous = current
+}
+
+func (h *unitsHistory) count(name string) int {
+	h.Lock()
+	defer h.Unlock()
+
+	return len(h.changes[name])
+}
+
+var unitsStatesHistory = &unitsHistory{
+	previous: make(map[string]unitPlacement),
+	changes:  make(map[string][]time.Time),
+}
+
+// UnitsFlappingCheck reports the units which changed of sub state or of
+// machine more than FLEET_FLAPPING_THRESHOLD times over the last
+// FLEET_FLAPPING_WINDOW seconds. The history is kept in memory, it starts
+// over when the client restarts.
+func UnitsFlappingCheck() check.ExtensionCheckResult {
+	snapshot, err := snapshots.get()
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	states := snapshot.states
+
+	blackListRegexp := DefaultBlacklist
+
+	if v := os.Getenv("BLACKLIST_REGEXP"); v != "" {
+		blackListRegexp = v
+	}
+
+	reg, err := regexp.Compile(blackListRegexp)
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	maxChanges := int(
+		utils.EnvironmentValueOrConst(
+			"FLEET_FLAPPING_THRESHOLD",
+			DefaultFlappingThreshold,
+		),
+	)
+	window := time.Duration(
+		utils.EnvironmentValueOrConst(
+			"FLEET_FLAPPING_WINDOW",
+			DefaultFlappingWindow,
+		),
+	) * time.Second
+
+	shared := sharedUnits(states)
+	unitsStatesHistory.record(states, shared, time.Now(), window)
+
+	flappingUnits := []string{}
+	for _, s := range states {
+		if reg.MatchString(s.Name) {
+			continue
+		}
+
+		key := unitKey(s, shared)
+
+		if n := unitsStatesHistory.count(key); n > maxChanges {
+			flappingUnits = append(
+				flappingUnits,
+				fmt.Sprintf("%s (%d changes)", key, n),
+			)
+		}
+	}
+
+	if len(flappingUnits) == 0 {
+		return handler.Ok("No unit is flapping")
+	}
+
+	sort.Strings(flappingUnits)
+
+	return handler.Warning(
+		fmt.Sprintf(
+			"Units changed more than %d times in %s: %s",
+			maxChanges,
+			window,
+			strings.Join(flappingUnits, ","),
+		),
+	)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/fleet/schema"
+)
+
+func TestUnitsHistorySharedUnits(t *testing.T) {
+	h := &unitsHistory{
+		previous: make(map[string]unitPlacement),
+		changes:  make(map[string][]time.Time),
+	}
+	m1 := &schema.UnitState{Name: "agent.service", MachineID: "m1", SystemdSubState: "running"}
+	m2 := &schema.UnitState{Name: "agent.service", MachineID: "m2", SystemdSubState: "dead"}
+	api := &schema.UnitState{Name: "api@1.service", MachineID: "m1", SystemdSubState: "running"}
+	now := time.Now()
+
+	// The etcd scheduler lists the states in no fixed order
+	for i, states := range [][]*schema.UnitState{
+		{m1, m2, api},
+		{m2, m1, api},
+		{m1, m2, api},
+	} {
+		at := now.Add(time.Duration(i) * time.Minute)
+		h.record(states, sharedUnits(states), at, time.Hour)
+	}
+
+	for _, key := range []string{"agent.service@m1", "agent.service@m2", "api@1.service"} {
+		if n := h.count(key); n != 0 {
+			t.Errorf("%s: %d changes, expected none", key, n)
+		}
+	}
+
+	moved := &schema.UnitState{Name: "api@1.service", MachineID: "m2", SystemdSubState: "running"}
+	states := []*schema.UnitState{m1, m2, moved}
+	h.record(states, sharedUnits(states), now.Add(time.Hour/2), time.Hour)
+
+	if n := h.count("api@1.service"); n != 1 {
+		t.Errorf("api@1.service: %d changes, expected 1", n)
+	}
+}
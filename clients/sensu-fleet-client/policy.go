@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+const (
+	DefaultRebalancingPolicyKey string = "/sensu/fleet/rebalancing"
+	etcdKeyNotFound                    = 100
+)
+
+// rebalancingPolicy is read from the REBALANCING_POLICY_KEY directory:
+//
+//	<key>/coefficient            overload coefficient of a machine
+//	<key>/blacklist              regexp of the units never rescheduled
+//	<key>/weights/<template>     weight of the units of a template, e.g.
+//	                             weights/elasticsearch@ = 4
+//	<key>/cooldown               set by Rebalance while cooling down
+//
+// Missing keys fall back on the built-in policy, every unit weighs 1.
+type rebalancingPolicy struct {
+	coefficient float32
+	blacklist   *regexp.Regexp
+	weights     map[string]float32
+}
+
+func rebalancingPolicyKey() string {
+	if v := os.Getenv("REBALANCING_POLICY_KEY"); v != "" {
+		return v
+	}
+
+	return DefaultRebalancingPolicyKey
+}
+
+func defaultRebalancingPolicy() *rebalancingPolicy {
+	return &rebalancingPolicy{
+		coefficient: overloadCoef,
+		blacklist:   regexp.MustCompile(rescheduleBlacklist),
+		weights:     make(map[string]float32),
+	}
+}
+
+func loadRebalancingPolicy(etcdClient *etcd.Client) (*rebalancingPolicy, error) {
+	policy := defaultRebalancingPolicy()
+
+	r, err := etcdClient.Get(rebalancingPolicyKey(), false, true)
+
+	if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == etcdKeyNotFound {
+		return policy, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, n := range r.Node.Nodes {
+		switch path.Base(n.Key) {
+		case "coefficient":
+			v, err := strconv.ParseFloat(n.Value, 32)
+
+			if err != nil || v <= 0 {
+				return nil, fmt.Errorf("%s: invalid coefficient %q", n.Key, n.Value)
+			}
+
+			policy.coefficient = float32(v)
+		case "blacklist":
+			reg, err := regexp.Compile(n.Value)
+
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", n.Key, err.Error())
+			}
+
+			policy.blacklist = reg
+		case "weights":
+			for _, w := range n.Nodes {
+				v, err := strconv.ParseFloat(w.Value, 32)
+
+				if err != nil || v < 0 {
+					return nil, fmt.Errorf("%s: invalid weight %q", w.Key, w.Value)
+				}
+
+				policy.weights[path.Base(w.Key)] = float32(v)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// unitTemplate returns the template of an instance unit, "foo@" for
+// "foo@1.service", and the name of the unit itself otherwise.
+func unitTemplate(name string) string {
+	if i := strings.Index(name, "@"); i >= 0 {
+		return name[:i+1]
+	}
+
+	return name
+}
+
+// templateUnit returns the template unit file of an instance unit,
+// "foo@.service" for "foo@1.service", and nothing for other units.
+func templateUnit(name string) string {
+	at := strings.Index(name, "@")
+	dot := strings.LastIndex(name, ".")
+
+	if at < 0 || dot < at {
+		return ""
+	}
+
+	return name[:at+1] + name[dot:]
+}
+
+func (p *rebalancingPolicy) weight(unit string) float32 {
+	if w, ok := p.weights[unit]; ok {
+		return w
+	}
+
+	if w, ok := p.weights[unitTemplate(unit)]; ok {
+		return w
+	}
+
+	return 1.0
+}
+
+// clusterLoad is the weighted load of every machine, grouped by role.
+type clusterLoad struct {
+	machinesByRoles map[string][]string
+	unitsByMachines map[string][]string
+	loads           map[string]float32
+}
+
+func newClusterLoad(
+	snapshot *registrySnapshot,
+	policy *rebalancingPolicy,
+) *clusterLoad {
+	load := &clusterLoad{
+		machinesByRoles: make(map[string][]string),
+		unitsByMachines: make(map[string][]string),
+		loads:           make(map[string]float32),
+	}
+
+	for _, machine := range snapshot.machines {
+		load.machinesByRoles[machine.Metadata["role"]] = append(
+			load.machinesByRoles[machine.Metadata["role"]],
+			machine.ID,
+		)
+	}
+
+	for _, unit := range snapshot.units {
+		load.unitsByMachines[unit.MachineID] = append(
+			load.unitsByMachines[unit.MachineID],
+			unit.Name,
+		)
+		load.loads[unit.MachineID] += policy.weight(unit.Name)
+	}
+
+	return load
+}
+
+func (l *clusterLoad) average(role string) float32 {
+	machines := l.machinesByRoles[role]
+
+	if len(machines) == 0 {
+		return 0.0
+	}
+
+	total := float32(0.0)
+
+	for _, id := range machines {
+		total += l.loads[id]
+	}
+
+	return total / float32(len(machines))
+}
+
+func (l *clusterLoad) max(role string) float32 {
+	max := float32(0.0)
+
+	for _, id := range l.machinesByRoles[role] {
+		if l.loads[id] > max {
+			max = l.loads[id]
+		}
+	}
+
+	return max
+}
+
+// imbalance is the ratio between the most loaded machine of a role and the
+// average load of the role, 1 when the role is perfectly balanced.
+func (l *clusterLoad) imbalance(role string) float32 {
+	average := l.average(role)
+
+	if average == 0 {
+		return 1.0
+	}
+
+	return l.max(role) / average
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/coreos/fleet/client"
+	"github.com/coreos/fleet/job"
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/upfluence/sensu-client-go/sensu/utils"
+)
+
+const (
+	etcdKeyExists               = 105
+	rebalanceUnscheduleTimeout  = 30 * time.Second
+	rebalanceUnschedulePollRate = time.Second
+)
+
+// rebalanceCooldownKey is set with a TTL after each rebalancing, no unit is
+// rescheduled while it exists. It lives along the policy, out of the
+// namespace of the machines.
+func rebalanceCooldownKey() string {
+	return path.Join(rebalancingPolicyKey(), "cooldown")
+}
+
+// rescheduleUnits unloads the units, waits for the engine to unschedule them,
+// and launches them again so that the engine picks new machines. The wait is
+// bounded by rebalanceUnscheduleTimeout for the whole run, the units still
+// scheduled by then are launched anyway.
+func rescheduleUnits(cl client.API, names []string) ([]string, []string) {
+	rescheduled := []string{}
+	failed := []string{}
+	pending := []string{}
+
+	fail := func(name string, err error) {
+		log.Printf("%s: %s", name, err.Error())
+		failed = append(failed, name)
+	}
+
+	launch := func(name string) {
+		if err := cl.SetUnitTargetState(name, string(job.JobStateLaunched)); err != nil {
+			fail(name, err)
+		} else {
+			rescheduled = append(rescheduled, name)
+		}
+	}
+
+	for _, name := range names {
+		if err := cl.SetUnitTargetState(name, string(job.JobStateInactive)); err != nil {
+			fail(name, err)
+		} else {
+			pending = append(pending, name)
+		}
+	}
+
+	deadline := time.Now().Add(rebalanceUnscheduleTimeout)
+
+	for len(pending) > 0 && time.Now().Before(deadline) {
+		scheduled := []string{}
+
+		for _, name := range pending {
+			u, err := cl.Unit(name)
+
+			switch {
+			case err != nil:
+				fail(name, err)
+			case u == nil:
+				fail(name, fmt.Errorf("unit destroyed while rescheduling"))
+			case u.MachineID != "":
+				scheduled = append(scheduled, name)
+			default:
+				launch(name)
+			}
+		}
+
+		pending = scheduled
+
+		if len(pending) > 0 {
+			time.Sleep(rebalanceUnschedulePollRate)
+		}
+	}
+
+	for _, name := range pending {
+		log.Printf("%s: still scheduled, launching it anyway", name)
+		launch(name)
+	}
+
+	return rescheduled, failed
+}
+
+// Rebalance reschedules at most REBALANCE_MAX_UNITS of the given units, and
+// only once per REBALANCE_COOLDOWN seconds, on every run when it is 0. With
+// REBALANCE_DRY_RUN set to true nothing is rescheduled. It returns a summary of what has been done.
+func Rebalance(cl client.API, etcdClient *etcd.Client, units []string) string {
+	dryRun := os.Getenv("REBALANCE_DRY_RUN") == "true"
+	maxUnits := int(
+		utils.EnvironmentValueOrConst(
+			"REBALANCE_MAX_UNITS",
+			DefaultRebalanceMaxUnits,
+		),
+	)
+	cooldown := utils.EnvironmentValueOrConst(
+		"REBALANCE_COOLDOWN",
+		DefaultRebalanceCooldown,
+	)
+
+	if cooldown < 0 {
+		return fmt.Sprintf("rebalancing aborted: invalid cooldown %g", cooldown)
+	}
+
+	if len(units) > maxUnits {
+		units = units[:maxUnits]
+	}
+
+	if dryRun {
+		if cooldown > 0 {
+			r, err := etcdClient.Get(rebalanceCooldownKey(), false, false)
+
+			if err == nil {
+				return fmt.Sprintf("rebalancing cooling down since %s", r.Node.Value)
+			}
+		}
+
+		return fmt.Sprintf("would reschedule: %s", strings.Join(units, ","))
+	}
+
+	// The cooldown is taken atomically so that concurrent runs never
+	// reschedule units together. A TTL of 0 would never expire, no cooldown is
+	// taken then.
+	if cooldown > 0 {
+		_, err := etcdClient.Create(
+			rebalanceCooldownKey(),
+			time.Now().UTC().Format(time.RFC3339),
+			uint64(cooldown),
+		)
+
+		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == etcdKeyExists {
+			return "rebalancing cooling down"
+		} else if err != nil {
+			return fmt.Sprintf("rebalancing aborted: %s", err.Error())
+		}
+	}
+
+	rescheduled, failed := rescheduleUnits(cl, units)
+
+	message := fmt.Sprintf("rescheduled: %s", strings.Join(rescheduled, ","))
+
+	if len(failed) > 0 {
+		message = fmt.Sprintf(
+			"%s, failed to reschedule: %s",
+			message,
+			strings.Join(failed, ","),
+		)
+	}
+
+	return message
+}
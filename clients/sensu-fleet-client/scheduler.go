@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/coreos/fleet/client"
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/schema"
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// scheduler lists what the checks look at, whatever runs the units of the
+// cluster. The namespace is read once per snapshot and handed to every
+// backend.
+type scheduler interface {
+	Machines(namespace etcd.Nodes) ([]machine.MachineState, error)
+	Units() ([]*schema.Unit, error)
+	UnitStates(namespace etcd.Nodes) ([]*schema.UnitState, error)
+}
+
+// fleetScheduler reads the fleet registry, the namespace only holds the infos
+// of the machines.
+type fleetScheduler struct {
+	client.API
+}
+
+func (s *fleetScheduler) Machines(etcd.Nodes) ([]machine.MachineState, error) {
+	return s.API.Machines()
+}
+
+func (s *fleetScheduler) UnitStates(etcd.Nodes) ([]*schema.UnitState, error) {
+	return s.API.UnitStates()
+}
+
+// newScheduler returns the backend selected by SCHEDULER, "fleet" by default
+// or "etcd".
+func newScheduler() (scheduler, error) {
+	switch name := os.Getenv("SCHEDULER"); name {
+	case "", "fleet":
+		cl, err := NewFleetClient()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &fleetScheduler{cl}, nil
+	case "etcd":
+		return &etcdScheduler{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown scheduler %s", name)
+	}
+}
+
+// etcdScheduler reads the machines and the systemd unit states published in
+// the namespace by export_infos.sh and export_units.sh:
+//
+//	/<namespace>/<machine id>/hostname
+//	/<namespace>/<machine id>/role
+//	/<namespace>/<machine id>/units/<unit> = "<load> <active> <sub>"
+//
+// A machine is listed as long as its hostname key has not expired. Without
+// scheduler there is no desired state and no unit file, it lists no unit:
+// fleet-units-checks, fleet-global-units-check, fleet-cluster-balancing and
+// fleet-templates-drift-check report nothing, and fleet-machines-check only
+// reports stale machines.
+type etcdScheduler struct{}
+
+func (s *etcdScheduler) Machines(
+	namespace etcd.Nodes,
+) ([]machine.MachineState, error) {
+	return namespaceMachines(namespace), nil
+}
+
+func (s *etcdScheduler) Units() ([]*schema.Unit, error) {
+	return nil, nil
+}
+
+func (s *etcdScheduler) UnitStates(
+	namespace etcd.Nodes,
+) ([]*schema.UnitState, error) {
+	return namespaceUnitStates(namespace), nil
+}
+
+func namespaceMachines(nodes etcd.Nodes) []machine.MachineState {
+	machines := []machine.MachineState{}
+
+	for _, n := range nodes {
+		m := machine.MachineState{
+			ID:       path.Base(n.Key),
+			Metadata: make(map[string]string),
+		}
+		alive := false
+
+		for _, info := range n.Nodes {
+			switch path.Base(info.Key) {
+			case "hostname":
+				alive = true
+			case "role":
+				m.Metadata["role"] = info.Value
+			}
+		}
+
+		if alive {
+			machines = append(machines, m)
+		}
+	}
+
+	return machines
+}
+
+func namespaceUnitStates(nodes etcd.Nodes) []*schema.UnitState {
+	states := []*schema.UnitState{}
+
+	for _, n := range nodes {
+		for _, info := range n.Nodes {
+			if path.Base(info.Key) != "units" {
+				continue
+			}
+
+			for _, u := range info.Nodes {
+				fields := strings.Fields(u.Value)
+
+				// Inactive units are not running on purpose, they may have
+				// been published by an older export_units.sh
+				if len(fields) != 3 || fields[1] == "inactive" {
+					continue
+				}
+
+				states = append(
+					states,
+					&schema.UnitState{
+						Name:               path.Base(u.Key),
+						MachineID:          path.Base(n.Key),
+						SystemdLoadState:   fields[0],
+						SystemdActiveState: fields[1],
+						SystemdSubState:    fields[2],
+					},
+				)
+			}
+		}
+	}
+
+	return states
+}
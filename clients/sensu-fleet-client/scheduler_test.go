@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/upfluence/sensu-client-go/sensu/check"
+)
+
+// namespaceResponse is the namespace published by export_infos.sh and
+// export_units.sh: the hostname of m2 expired, and m1 runs api.service next to
+// a stopped backup.service.
+const namespaceResponse = `{
+  "action": "get",
+  "node": {
+    "key": "/machines",
+    "dir": true,
+    "nodes": [
+      {
+        "key": "/machines/m1",
+        "dir": true,
+        "nodes": [
+          {"key": "/machines/m1/hostname", "value": "core-1"},
+          {"key": "/machines/m1/role", "value": "api"},
+          {
+            "key": "/machines/m1/units",
+            "dir": true,
+            "nodes": [
+              {
+                "key": "/machines/m1/units/api.service",
+                "value": "loaded active running"
+              },
+              {
+                "key": "/machines/m1/units/backup.service",
+                "value": "loaded inactive dead"
+              }
+            ]
+          }
+        ]
+      },
+      {
+        "key": "/machines/m2",
+        "dir": true,
+        "nodes": [{"key": "/machines/m2/role", "value": "api"}]
+      }
+    ]
+  }
+}`
+
+func TestEtcdSchedulerSnapshot(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Etcd-Index", "1")
+			w.Write([]byte(namespaceResponse))
+		}),
+	)
+	defer server.Close()
+
+	snapshots.scheduler = &etcdScheduler{}
+	snapshots.etcdClient = etcd.NewClient([]string{server.URL})
+	snapshots.snapshot = nil
+
+	defer func() {
+		snapshots.scheduler = nil
+		snapshots.etcdClient = nil
+		snapshots.snapshot = nil
+	}()
+
+	snapshot, err := snapshots.get()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshot.machines) != 1 || snapshot.machines[0].ID != "m1" ||
+		snapshot.machines[0].Metadata["role"] != "api" {
+		t.Errorf("machines: %+v, expected m1 only", snapshot.machines)
+	}
+
+	if len(snapshot.states) != 1 || snapshot.states[0].Name != "api.service" ||
+		snapshot.states[0].SystemdSubState != "running" {
+		t.Errorf("states: %+v, expected api.service only", snapshot.states)
+	}
+
+	expectedInfos := map[string]map[string]string{
+		"m1": {"hostname": "core-1", "role": "api"},
+		"m2": {"role": "api"},
+	}
+
+	if !reflect.DeepEqual(snapshot.infos, expectedInfos) {
+		t.Errorf("infos: %v, expected %v", snapshot.infos, expectedInfos)
+	}
+
+	if result := UnitsStatesCheck(); result.Status != check.Success {
+		t.Errorf("fleet-unit-states-checks: %d, %s", result.Status, result.Output)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/coreos/fleet/machine"
+	"github.com/coreos/fleet/schema"
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/upfluence/sensu-client-go/sensu/utils"
+)
+
+const DefaultSnapshotInterval float64 = 30.0
+
+// registrySnapshot is the state of the cluster shared by every check run
+// within FLEET_SNAPSHOT_INTERVAL seconds.
+type registrySnapshot struct {
+	machines []machine.MachineState
+	units    []*schema.Unit
+	states   []*schema.UnitState
+	// infos are the keys set by export_infos.sh in the namespace, by machine
+	infos     map[string]map[string]string
+	fetchedAt time.Time
+}
+
+func (s *registrySnapshot) hostname(machineID string) (string, bool) {
+	h, ok := s.infos[machineID]["hostname"]
+
+	return h, ok
+}
+
+// machineName names a machine by its registered hostname, by its id when it
+// has none.
+func (s *registrySnapshot) machineName(machineID string) string {
+	if h, ok := s.hostname(machineID); ok {
+		return h
+	}
+
+	return machineID
+}
+
+// fetchNamespace reads the whole namespace with a single recursive GET.
+func fetchNamespace(etcdClient *etcd.Client) (etcd.Nodes, error) {
+	r, err := etcdClient.Get(fmt.Sprintf("/%s", EtcdNamespace()), false, true)
+
+	if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == etcdKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return r.Node.Nodes, nil
+}
+
+// namespaceInfos reads the keys of every machine, the units directory
+// published by export_units.sh is not an info.
+func namespaceInfos(nodes etcd.Nodes) map[string]map[string]string {
+	infos := make(map[string]map[string]string)
+
+	for _, n := range nodes {
+		machineInfos := make(map[string]string)
+
+		for _, info := range n.Nodes {
+			if info.Dir || path.Base(info.Key) == "units" {
+				continue
+			}
+
+			machineInfos[path.Base(info.Key)] = info.Value
+		}
+
+		infos[path.Base(n.Key)] = machineInfos
+	}
+
+	return infos
+}
+
+// snapshotCache holds the scheduler and etcd client shared by the checks and
+// the last snapshot they fetched.
+type snapshotCache struct {
+	sync.Mutex
+	scheduler  scheduler
+	etcdClient *etcd.Client
+	snapshot   *registrySnapshot
+}
+
+var snapshots = &snapshotCache{}
+
+func (c *snapshotCache) clients() (scheduler, *etcd.Client, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.lockedClients()
+}
+
+func (c *snapshotCache) lockedClients() (scheduler, *etcd.Client, error) {
+	if c.scheduler == nil {
+		s, err := newScheduler()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		c.scheduler = s
+		c.etcdClient = NewEtcdClient()
+	}
+
+	return c.scheduler, c.etcdClient, nil
+}
+
+func (c *snapshotCache) get() (*registrySnapshot, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	interval := time.Duration(
+		utils.EnvironmentValueOrConst(
+			"FLEET_SNAPSHOT_INTERVAL",
+			DefaultSnapshotInterval,
+		),
+	) * time.Second
+
+	if c.snapshot != nil && time.Since(c.snapshot.fetchedAt) < interval {
+		return c.snapshot, nil
+	}
+
+	cl, etcdClient, err := c.lockedClients()
+
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := fetchNamespace(etcdClient)
+
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &registrySnapshot{
+		infos:     namespaceInfos(nodes),
+		fetchedAt: time.Now(),
+	}
+
+	if snapshot.machines, err = cl.Machines(nodes); err != nil {
+		return nil, err
+	}
+
+	if snapshot.units, err = cl.Units(); err != nil {
+		return nil, err
+	}
+
+	if snapshot.states, err = cl.UnitStates(nodes); err != nil {
+		return nil, err
+	}
+
+	c.snapshot = snapshot
+
+	return snapshot, nil
+}
+
+// invalidate drops the snapshot once the checks changed the cluster.
+func (c *snapshotCache) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.snapshot = nil
+}
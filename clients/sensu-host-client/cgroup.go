@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Above this value a v1 memory limit is the "unlimited" page aligned
+// int64 max
+const unlimitedMemory = 1 << 62
+
+var errUnlimited = errors.New("unlimited")
+
+// cgroupHierarchy locates the cgroup of docker containers, whatever the
+// cgroup version (v1 per subsystem hierarchies or v2 unified hierarchy) and
+// the cgroup driver (systemd or cgroupfs) used by the docker daemon.
+type cgroupHierarchy struct {
+	root    string
+	unified bool
+}
+
+func newCgroupHierarchy(root string) *cgroupHierarchy {
+	_, err := os.Stat(filepath.Join(root, "cgroup.controllers"))
+
+	return &cgroupHierarchy{root: root, unified: err == nil}
+}
+
+func (h *cgroupHierarchy) containerPath(subsystem, id string) (string, error) {
+	base := h.root
+
+	if !h.unified {
+		base = filepath.Join(base, subsystem)
+	}
+
+	for _, p := range []string{
+		// systemd driver
+		filepath.Join(base, "system.slice", fmt.Sprintf("docker-%s.scope", id)),
+		// cgroupfs driver
+		filepath.Join(base, "docker", id),
+	} {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("%s: no %s cgroup found", id, subsystem)
+}
+
+// containerStat is a value read from the cgroup of a container, v1 and v2
+// read it from their own files.
+type containerStat struct {
+	name      string
+	subsystem string
+	v1        func(dir string) (float64, error)
+	v2        func(dir string) (float64, error)
+}
+
+func (s *containerStat) fetch(h *cgroupHierarchy, id string) (float64, error) {
+	dir, err := h.containerPath(s.subsystem, id)
+
+	if err != nil {
+		return 0.0, err
+	}
+
+	if h.unified {
+		return s.v2(dir)
+	}
+
+	return s.v1(dir)
+}
+
+var containerStats = []*containerStat{
+	{
+		name:      "memory",
+		subsystem: "memory",
+		v1:        readCgroupValue("memory.usage_in_bytes"),
+		v2:        readCgroupValue("memory.current"),
+	},
+	{
+		// Same as docker stats: the inactive page cache is reclaimable
+		name:      "memory_working_set",
+		subsystem: "memory",
+		v1: readWorkingSet(
+			"memory.usage_in_bytes",
+			readCgroupKeyedValue("memory.stat", "total_inactive_file", 1),
+		),
+		v2: readWorkingSet(
+			"memory.current",
+			readCgroupKeyedValue("memory.stat", "inactive_file", 1),
+		),
+	},
+	{
+		name:      "memory_limit",
+		subsystem: "memory",
+		v1:        readMemoryLimit("memory.limit_in_bytes"),
+		v2:        readMemoryLimit("memory.max"),
+	},
+	{
+		name:      "memory_rss",
+		subsystem: "memory",
+		v1:        readCgroupKeyedValue("memory.stat", "total_rss", 1),
+		v2:        readCgroupKeyedValue("memory.stat", "anon", 1),
+	},
+	{
+		name:      "memory_cache",
+		subsystem: "memory",
+		v1:        readCgroupKeyedValue("memory.stat", "total_cache", 1),
+		v2:        readCgroupKeyedValue("memory.stat", "file", 1),
+	},
+	{
+		name:      "cpuacct",
+		subsystem: "cpuacct",
+		v1:        readCgroupValue("cpuacct.usage"),
+		// cpuacct.usage is in nanoseconds, usage_usec in microseconds
+		v2: readCgroupKeyedValue("cpu.stat", "usage_usec", 1000),
+	},
+	{
+		name:      "cpu_throttled_periods",
+		subsystem: "cpu",
+		v1:        readCgroupKeyedValue("cpu.stat", "nr_throttled", 1),
+		v2:        readCgroupKeyedValue("cpu.stat", "nr_throttled", 1),
+	},
+	{
+		name:      "cpu_throttled_time",
+		subsystem: "cpu",
+		v1:        readCgroupKeyedValue("cpu.stat", "throttled_time", 1),
+		v2:        readCgroupKeyedValue("cpu.stat", "throttled_usec", 1000),
+	},
+	{
+		name:      "blkio_read",
+		subsystem: "blkio",
+		v1:        readBlkioBytes("Read"),
+		v2:        readIOStatBytes("rbytes"),
+	},
+	{
+		name:      "blkio_write",
+		subsystem: "blkio",
+		v1:        readBlkioBytes("Write"),
+		v2:        readIOStatBytes("wbytes"),
+	},
+}
+
+func readCgroupValue(file string) func(string) (float64, error) {
+	return func(dir string) (float64, error) {
+		blob, err := ioutil.ReadFile(filepath.Join(dir, file))
+
+		if err != nil {
+			return 0.0, err
+		}
+
+		return strconv.ParseFloat(strings.TrimSpace(string(blob)), 64)
+	}
+}
+
+// readCgroupKeyedValue reads a value of flat keyed files such as cpu.stat or
+// memory.stat, made of "<key> <value>" lines.
+func readCgroupKeyedValue(
+	file, key string,
+	scale float64,
+) func(string) (float64, error) {
+	return func(dir string) (float64, error) {
+		f, err := os.Open(filepath.Join(dir, file))
+
+		if err != nil {
+			return 0.0, err
+		}
+
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+
+			if len(fields) != 2 || fields[0] != key {
+				continue
+			}
+
+			v, err := strconv.ParseFloat(fields[1], 64)
+
+			if err != nil {
+				return 0.0, err
+			}
+
+			return v * scale, nil
+		}
+
+		if err := scanner.Err(); err != nil {
+			return 0.0, err
+		}
+
+		return 0.0, fmt.Errorf("%s: %s not found", file, key)
+	}
+}
+
+// readWorkingSet reads the memory usage of a cgroup minus its inactive page
+// cache.
+func readWorkingSet(
+	file string,
+	inactive func(string) (float64, error),
+) func(string) (float64, error) {
+	return func(dir string) (float64, error) {
+		usage, err := readCgroupValue(file)(dir)
+
+		if err != nil {
+			return 0.0, err
+		}
+
+		cache, err := inactive(dir)
+
+		if err != nil {
+			return 0.0, err
+		}
+
+		if cache > usage {
+			return 0.0, nil
+		}
+
+		return usage - cache, nil
+	}
+}
+
+func readMemoryLimit(file string) func(string) (float64, error) {
+	return func(dir string) (float64, error) {
+		blob, err := ioutil.ReadFile(filepath.Join(dir, file))
+
+		if err != nil {
+			return 0.0, err
+		}
+
+		value := strings.TrimSpace(string(blob))
+
+		if value == "max" {
+			return 0.0, errUnlimited
+		}
+
+		v, err := strconv.ParseFloat(value, 64)
+
+		if err != nil {
+			return 0.0, err
+		}
+
+		if v >= unlimitedMemory {
+			return 0.0, errUnlimited
+		}
+
+		return v, nil
+	}
+}
+
+// readBlkioBytes sums the bytes of an operation over every device of the v1
+// blkio.throttle.io_service_bytes, made of "<major>:<minor> <op> <value>"
+// lines.
+func readBlkioBytes(op string) func(string) (float64, error) {
+	return func(dir string) (float64, error) {
+		f, err := os.Open(filepath.Join(dir, "blkio.throttle.io_service_bytes"))
+
+		if err != nil {
+			return 0.0, err
+		}
+
+		defer f.Close()
+
+		total := 0.0
+		scanner := bufio.NewScanner(f)
+
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+
+			if len(fields) != 3 || fields[1] != op {
+				continue
+			}
+
+			v, err := strconv.ParseFloat(fields[2], 64)
+
+			if err != nil {
+				return 0.0, err
+			}
+
+			total += v
+		}
+
+		return total, scanner.Err()
+	}
+}
+
+// readIOStatBytes sums a counter over every device of the v2 io.stat, made of
+// "<major>:<minor> <key>=<value>..." lines.
+func readIOStatBytes(key string) func(string) (float64, error) {
+	return func(dir string) (float64, error) {
+		f, err := os.Open(filepath.Join(dir, "io.stat"))
+
+		if err != nil {
+			return 0.0, err
+		}
+
+		defer f.Close()
+
+		total := 0.0
+		scanner := bufio.NewScanner(f)
+
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+
+			if len(fields) < 2 {
+				continue
+			}
+
+			for _, field := range fields[1:] {
+				kv := strings.SplitN(field, "=", 2)
+
+				if len(kv) != 2 || kv[0] != key {
+					continue
+				}
+
+				v, err := strconv.ParseFloat(kv[1], 64)
+
+				if err != nil {
+					return 0.0, err
+				}
+
+				total += v
+			}
+		}
+
+		return total, scanner.Err()
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+const fixtureContainerID = "0123456789ab"
+
+var cgroupLayouts = []struct {
+	name    string
+	unified bool
+	// container is the path of the container cgroup within a hierarchy
+	container string
+}{
+	{
+		name:      "v1-systemd",
+		container: "system.slice/docker-" + fixtureContainerID + ".scope",
+	},
+	{
+		name:      "v1-cgroupfs",
+		container: "docker/" + fixtureContainerID,
+	},
+	{
+		name:      "v2-systemd",
+		unified:   true,
+		container: "system.slice/docker-" + fixtureContainerID + ".scope",
+	},
+	{
+		name:      "v2-cgroupfs",
+		unified:   true,
+		container: "docker/" + fixtureContainerID,
+	},
+}
+
+// Every layout holds the same values, v2 ones in microseconds
+var expectedCgroupValues = map[string]float64{
+	"memory":  104857600,
+	"cpuacct": 123000,
+}
+
+func TestCgroupHierarchyContainerPath(t *testing.T) {
+	for _, layout := range cgroupLayouts {
+		root := filepath.Join("testdata", "cgroup", layout.name)
+		h := newCgroupHierarchy(root)
+
+		if h.unified != layout.unified {
+			t.Errorf("%s: unified = %v", layout.name, h.unified)
+		}
+
+		for _, subsystem := range []string{"memory", "cpu", "cpuacct", "blkio"} {
+			expected := filepath.Join(root, subsystem, layout.container)
+
+			if layout.unified {
+				expected = filepath.Join(root, layout.container)
+			}
+
+			p, err := h.containerPath(subsystem, fixtureContainerID)
+
+			if err != nil {
+				t.Errorf("%s: %s: %s", layout.name, subsystem, err.Error())
+			} else if p != expected {
+				t.Errorf("%s: %s: %s, expected %s", layout.name, subsystem, p, expected)
+			}
+		}
+
+		if _, err := h.containerPath("memory", "unknown"); err == nil {
+			t.Errorf("%s: cgroup found for an unknown container", layout.name)
+		}
+	}
+}
+
+func TestContainerStats(t *testing.T) {
+	for _, layout := range cgroupLayouts {
+		h := newCgroupHierarchy(filepath.Join("testdata", "cgroup", layout.name))
+
+		for _, stat := range containerStats {
+			expected, ok := expectedCgroupValues[stat.name]
+
+			if !ok {
+				continue
+			}
+
+			v, err := stat.fetch(h, fixtureContainerID)
+
+			if err != nil {
+				t.Errorf("%s: %s: %s", layout.name, stat.name, err.Error())
+			} else if v != expected {
+				t.Errorf("%s: %s: %v, expected %v", layout.name, stat.name, v, expected)
+			}
+		}
+	}
+}
@@ -2,17 +2,14 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"log"
+	"math"
 	"os"
-	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/cloudfoundry/bytefmt"
 	"github.com/cloudfoundry/gosigar"
-	"github.com/coreos/go-etcd/etcd"
-	"github.com/fsouza/go-dockerclient"
 	"github.com/upfluence/sensu-client-go/sensu"
 	"github.com/upfluence/sensu-client-go/sensu/check"
 	"github.com/upfluence/sensu-client-go/sensu/handler"
@@ -30,17 +27,49 @@ const (
 	DEFAULT_DOCKER_VSZ_WARNING   = 2500 * bytefmt.MEGABYTE
 	DEFAULT_DISK_WARNING         = 130 * bytefmt.GIGABYTE
 	DEFAULT_DISK_ERROR           = 150 * bytefmt.GIGABYTE
+	DEFAULT_DISK_PERCENT_WARNING = 85
+	DEFAULT_DISK_PERCENT_ERROR   = 95
+	DEFAULT_INODES_WARNING       = 80
+	DEFAULT_INODES_ERROR         = 90
 	DOCKER_ENDPOINT              = "unix:///var/run/docker.sock"
+	CGROUP_ROOT                  = "/sys/fs/cgroup"
 )
 
-var metrics = []string{"memory.usage_in_bytes", "cpuacct.usage"}
+const (
+	statusOk = iota
+	statusWarning
+	statusError
+)
 
 type Check struct {
 	Name             string
-	errorThreshold   float64
-	warningThreshold float64
+	errorThreshold   *liveThreshold
+	warningThreshold *liveThreshold
 	fetchValue       func() (float64, error)
+	fetchTotal       func() (float64, error)
 	displayValue     func(float64) string
+	// below makes the check fail when the value drops under the thresholds
+	below bool
+	// percentValue is set when the value already is a percentage, "90%"
+	// thresholds then compare to it as is
+	percentValue bool
+	// signed values, such as an offset, compare to the thresholds by their
+	// magnitude
+	signed bool
+	// samples is the number of consecutive runs a threshold must be exceeded
+	// for before the check fails, a single one when unset
+	samples int
+
+	mu       sync.Mutex
+	statuses []int
+}
+
+func (c *Check) exceeds(value, limit float64) bool {
+	if c.below {
+		return value < limit
+	}
+
+	return value > limit
 }
 
 func (c *Check) Metric() check.ExtensionCheckResult {
@@ -63,88 +92,167 @@ func (c *Check) Metric() check.ExtensionCheckResult {
 	return metric.Render()
 }
 
-func (c *Check) Check() check.ExtensionCheckResult {
+func (c *Check) evaluate() (int, string) {
 	value := 0.0
 	if v, err := c.fetchValue(); err != nil {
-		return handler.Error(fmt.Sprintf("%s: %s", c.Name, err.Error()))
+		return statusError, fmt.Sprintf("%s: %s", c.Name, err.Error())
 	} else {
 		value = v
 	}
 
 	message := fmt.Sprintf("%s: %s", c.Name, c.displayValue(value))
+	errorThreshold := c.errorThreshold.get()
+	warningThreshold := c.warningThreshold.get()
+	total := 0.0
 
-	if value > c.errorThreshold {
-		return handler.Error(message)
-	} else if value > c.warningThreshold {
-		return handler.Warning(message)
+	if c.fetchTotal != nil {
+		v, err := c.fetchTotal()
+
+		if err != nil {
+			return statusError, fmt.Sprintf("%s: %s", c.Name, err.Error())
+		}
+
+		total = v
+
+		if total > 0 {
+			message = fmt.Sprintf("%s (%.1f%%)", message, 100*value/total)
+		}
+	} else if c.percentValue {
+		total = 100.0
+	} else if errorThreshold.percentage || warningThreshold.percentage {
+		return statusError, fmt.Sprintf(
+			"%s: percentage thresholds are not supported",
+			c.Name,
+		)
 	}
 
-	return handler.Ok(message)
-}
+	message = fmt.Sprintf(
+		"%s, error: %s, warning: %s",
+		message,
+		c.displayThreshold(errorThreshold),
+		c.displayThreshold(warningThreshold),
+	)
 
-func displayBytes(v float64) string {
-	return bytefmt.ByteSize(uint64(v))
+	if c.signed {
+		value = math.Abs(value)
+	}
+
+	status := statusOk
+
+	if c.exceeds(value, errorThreshold.limit(total)) {
+		status = statusError
+	} else if c.exceeds(value, warningThreshold.limit(total)) {
+		status = statusWarning
+	}
+
+	return c.sustained(status), message
 }
 
-func fetchThreshold(key string, defaultValue int) float64 {
-	var machines []string
+// sustained keeps the status of the last samples runs and returns the best of
+// them, a threshold only fails the check once exceeded by all of them.
+func (c *Check) sustained(status int) int {
+	if c.samples <= 1 {
+		return status
+	}
 
-	if os.Getenv("ETCD_URL") == "" {
-		machines = append(machines, "http://127.0.0.1:2379")
-	} else {
-		machines = strings.Split(os.Getenv("ETCD_URL"), ",")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.statuses = append(c.statuses, status)
+
+	if len(c.statuses) > c.samples {
+		c.statuses = c.statuses[len(c.statuses)-c.samples:]
 	}
 
-	etcdClient := etcd.NewClient(machines)
+	if len(c.statuses) < c.samples {
+		return statusOk
+	}
 
-	resp, err := etcdClient.Get(
-		fmt.Sprintf("/sensu/host/%s/%s", os.Getenv("SENSU_HOSTNAME"), key),
-		false,
-		false,
-	)
+	for _, s := range c.statuses {
+		if s < status {
+			status = s
+		}
+	}
 
-	if err != nil {
-		log.Printf(
-			"%s: %s: %s, err: %s",
-			os.Getenv("SENSU_HOSTNAME"),
-			key,
-			bytefmt.ByteSize(uint64(defaultValue)),
-			err.Error(),
-		)
+	return status
+}
 
-		return float64(defaultValue)
+func (c *Check) displayThreshold(t threshold) string {
+	if t.percentage {
+		return fmt.Sprintf("%g%% (%s)", t.value, t.level)
 	}
 
-	size, err := bytefmt.ToBytes(resp.Node.Value)
+	return fmt.Sprintf("%s (%s)", c.displayValue(t.value), t.level)
+}
+
+func (c *Check) Check() check.ExtensionCheckResult {
+	return render(c.evaluate())
+}
+
+// checkGroup aggregates several checks under a single sensu check, reporting
+// the worst status of its members.
+type checkGroup []*Check
+
+func (g checkGroup) Check() check.ExtensionCheckResult {
+	status := statusOk
+	messages := []string{}
+
+	for _, c := range g {
+		s, message := c.evaluate()
 
-	if err != nil {
-		log.Printf(
-			"%s: %s: %s, err: %s",
-			os.Getenv("SENSU_HOSTNAME"),
-			key,
-			bytefmt.ByteSize(uint64(defaultValue)),
-			err.Error(),
+		if s > status {
+			status = s
+		}
+
+		messages = append(messages, message)
+	}
+
+	return render(status, strings.Join(messages, ", "))
+}
+
+func (g checkGroup) Metric() check.ExtensionCheckResult {
+	metric := &handler.Metric{}
+
+	for _, c := range g {
+		v, err := c.fetchValue()
+
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		metric.AddPoint(
+			&handler.Point{
+				fmt.Sprintf("%s.%s", os.Getenv("SENSU_HOSTNAME"), c.Name),
+				v,
+			},
 		)
+	}
 
-		return float64(defaultValue)
+	return metric.Render()
+}
+
+func render(status int, message string) check.ExtensionCheckResult {
+	switch status {
+	case statusError:
+		return handler.Error(message)
+	case statusWarning:
+		return handler.Warning(message)
 	}
 
-	log.Printf(
-		"%s: %s: %s",
-		os.Getenv("SENSU_HOSTNAME"),
-		key,
-		bytefmt.ByteSize(uint64(size)),
-	)
+	return handler.Ok(message)
+}
 
-	return float64(size)
+func displayBytes(v float64) string {
+	return bytefmt.ByteSize(uint64(v))
 }
 
 var (
 	sgr      = &sigar.ConcreteSigar{}
 	memCheck = &Check{
 		Name:             "mem",
-		errorThreshold:   fetchThreshold("MEM_ERROR", DEFAULT_MEM_ERROR),
-		warningThreshold: fetchThreshold("MEM_WARNING", DEFAULT_MEM_WARNING),
+		errorThreshold:   fetchThreshold("MEM_ERROR", absolute(DEFAULT_MEM_ERROR)),
+		warningThreshold: fetchThreshold("MEM_WARNING", absolute(DEFAULT_MEM_WARNING)),
 		displayValue:     displayBytes,
 		fetchValue: func() (float64, error) {
 			v, err := sgr.GetMem()
@@ -155,12 +263,21 @@ var (
 
 			return float64(v.ActualUsed), nil
 		},
+		fetchTotal: func() (float64, error) {
+			v, err := sgr.GetMem()
+
+			if err != nil {
+				return 0.0, err
+			}
+
+			return float64(v.Total), nil
+		},
 	}
 
 	swapCheck = &Check{
 		Name:             "Swap",
-		errorThreshold:   fetchThreshold("SWAP_ERROR", DEFAULT_SWAP_ERROR),
-		warningThreshold: fetchThreshold("SWAP_WARNING", DEFAULT_SWAP_WARNING),
+		errorThreshold:   fetchThreshold("SWAP_ERROR", absolute(DEFAULT_SWAP_ERROR)),
+		warningThreshold: fetchThreshold("SWAP_WARNING", absolute(DEFAULT_SWAP_WARNING)),
 		displayValue:     displayBytes,
 		fetchValue: func() (float64, error) {
 			v, err := sgr.GetSwap()
@@ -171,17 +288,26 @@ var (
 
 			return float64(v.Used), nil
 		},
+		fetchTotal: func() (float64, error) {
+			v, err := sgr.GetSwap()
+
+			if err != nil {
+				return 0.0, err
+			}
+
+			return float64(v.Total), nil
+		},
 	}
 
 	loadAverageCheck = &Check{
 		Name: "load_average",
 		errorThreshold: fetchThreshold(
 			"LOAD_AVERAGE_ERROR",
-			DEFAULT_LOAD_AVERAGE_ERROR,
+			absolute(DEFAULT_LOAD_AVERAGE_ERROR),
 		),
 		warningThreshold: fetchThreshold(
 			"LOAD_AVERAGE_WARNING",
-			DEFAULT_LOAD_AVERAGE_WARNING,
+			absolute(DEFAULT_LOAD_AVERAGE_WARNING),
 		),
 		displayValue: func(b float64) string { return fmt.Sprintf("%.2f", b) },
 		fetchValue: func() (float64, error) {
@@ -195,179 +321,140 @@ var (
 		},
 	}
 
-	diskCheck = &Check{
-		Name:             "disk",
-		errorThreshold:   fetchThreshold("DISK_ERROR", DEFAULT_DISK_ERROR),
-		warningThreshold: fetchThreshold("DISK_WARNING", DEFAULT_DISK_WARNING),
-		displayValue:     displayBytes,
-		fetchValue: func() (float64, error) {
-			v, err := sgr.GetFileSystemUsage("/")
-
-			if err != nil {
-				return 0.0, err
-			}
-
-			return float64(v.Used * 1024), nil
-		},
-	}
-
-	cpuCheck = &Check{
-		Name:             "cpu",
-		errorThreshold:   0.0,
-		warningThreshold: 0.0,
-		displayValue:     displayBytes,
-		fetchValue: func() (float64, error) {
-			responseChan, _ := sgr.CollectCpuStats(5 * time.Second)
-
-			v := <-responseChan
-
-			return float64(v.Total()), nil
-		},
-	}
-
 	dockerVSZCheck = &Check{
 		Name:             "docker_vsz",
-		errorThreshold:   fetchThreshold("DOCKER_VSZ_ERROR", DEFAULT_DOCKER_VSZ_ERROR),
-		warningThreshold: fetchThreshold("DOCKER_VSZ_WARNING", DEFAULT_DOCKER_VSZ_WARNING),
+		errorThreshold:   fetchThreshold("DOCKER_VSZ_ERROR", absolute(DEFAULT_DOCKER_VSZ_ERROR)),
+		warningThreshold: fetchThreshold("DOCKER_VSZ_WARNING", absolute(DEFAULT_DOCKER_VSZ_WARNING)),
 		displayValue:     displayBytes,
 		fetchValue: func() (float64, error) {
-			f, err := os.Open("/var/run/docker.pid")
+			s, err := processTargetByName("docker").stats()
 
 			if err != nil {
 				return 0.0, err
 			}
 
-			defer f.Close()
+			return s.vsz, nil
+		},
+	}
+)
 
-			blob, err := ioutil.ReadAll(f)
+func main() {
+	cfg := sensu.NewConfigFromFlagSet(sensu.ExtractFlags())
 
-			if err != nil {
-				return 0.0, err
-			}
+	t := rabbitmq.NewRabbitMQTransport(cfg.RabbitMQURI())
+	client := sensu.NewClient(t, cfg)
 
-			pid, err := strconv.Atoi(string(blob))
+	go watchThresholds()
 
-			if err != nil {
-				return 0.0, err
-			}
+	diskChecks := checkGroup{}
 
-			mem := sigar.ProcMem{}
+	for _, fs := range mountedFileSystems() {
+		name := mountName(fs.DirName)
+		space, inodes := diskCheck(fs), inodeCheck(fs)
 
-			if err := mem.Get(pid); err != nil {
-				return 0.0, err
-			}
+		check.Store[fmt.Sprintf("host-disk-%s-check", name)] = &check.ExtensionCheck{
+			checkGroup{space, inodes}.Check,
+		}
+		check.Store[fmt.Sprintf("host-disk-%s-metric", name)] = &check.ExtensionCheck{
+			checkGroup{space, inodes}.Metric,
+		}
 
-			return float64(mem.Size), nil
-		},
+		diskChecks = append(diskChecks, space, inodes)
 	}
-)
 
-func containerMetric(
-	container docker.APIContainers,
-	metric string,
-) (*handler.Point, error) {
-	f, err := os.Open(
-		fmt.Sprintf(
-			"/sys/fs/cgroup/%s/system.slice/docker-%s.scope/%s",
-			strings.Split(metric, ".")[0],
-			container.ID,
-			metric,
-		),
-	)
-
-	if err != nil {
-		return nil, err
+	check.Store["host-mem-check"] = &check.ExtensionCheck{memCheck.Check}
+	check.Store["host-disk-check"] = &check.ExtensionCheck{diskChecks.Check}
+	check.Store["host-docker_vsz-check"] = &check.ExtensionCheck{
+		dockerVSZCheck.Check,
 	}
-
-	defer f.Close()
-
-	blob, err := ioutil.ReadAll(f)
-	if err != nil {
-		return nil, err
+	check.Store["host-load_average-check"] = &check.ExtensionCheck{
+		loadAverageCheck.Check,
 	}
-
-	valString := string(blob)
-	val, err := strconv.Atoi(valString[:len(valString)-1])
-
-	if err != nil {
-		return nil, err
+	check.Store["host-mem-metric"] = &check.ExtensionCheck{memCheck.Metric}
+	check.Store["host-disk-metric"] = &check.ExtensionCheck{diskChecks.Metric}
+	check.Store["host-cpu-check"] = &check.ExtensionCheck{cpuChecks.Check}
+	check.Store["host-cpu-metric"] = &check.ExtensionCheck{CpuMetric}
+	check.Store["host-load_average-metric"] = &check.ExtensionCheck{
+		loadAverageCheck.Metric,
+	}
+	check.Store["host-docker_vsz-metric"] = &check.ExtensionCheck{
+		dockerVSZCheck.Metric,
 	}
 
-	name := container.Names[0]
-	name = name[1:len(name)]
+	processChecks := checkGroup{}
+	targets := enabledProcessTargets()
 
-	return &handler.Point{
-		fmt.Sprintf(
-			"docker.containers.%s.%s.%s",
-			os.Getenv("SENSU_HOSTNAME"),
-			name,
-			strings.Split(metric, ".")[0],
-		),
-		float64(val),
-	}, nil
-}
+	for _, t := range targets {
+		checks := t.checks()
 
-func DockerContainersMetric() check.ExtensionCheckResult {
-	endpoint := os.Getenv("DOCKER_ENDPOINT")
-	metric := handler.Metric{}
+		check.Store[fmt.Sprintf("host-process-%s-check", t.name)] = &check.ExtensionCheck{
+			checks.Check,
+		}
+		check.Store[fmt.Sprintf("host-process-%s-metric", t.name)] = &check.ExtensionCheck{
+			t.Metric,
+		}
 
-	if endpoint == "" {
-		endpoint = DOCKER_ENDPOINT
+		processChecks = append(processChecks, checks...)
 	}
 
-	client, _ := docker.NewClient(endpoint)
-
-	cs, err := client.ListContainers(docker.ListContainersOptions{})
+	check.Store["host-process-check"] = &check.ExtensionCheck{
+		processChecks.Check,
+	}
+	check.Store["host-process-metric"] = &check.ExtensionCheck{
+		func() check.ExtensionCheckResult {
+			return processMetric(targets)
+		},
+	}
 
-	if err != nil {
-		log.Println(err.Error())
+	ioChecks := checkGroup{}
 
-		return metric.Render()
+	for _, device := range blockDevices() {
+		ioChecks = append(ioChecks, diskIOChecks(device)...)
 	}
 
-	for _, container := range cs {
-		for _, met := range metrics {
-			point, err := containerMetric(container, met)
+	check.Store["host-diskio-check"] = &check.ExtensionCheck{ioChecks.Check}
+	check.Store["host-diskio-metric"] = &check.ExtensionCheck{DiskIOMetric}
 
-			if err != nil {
-				log.Println(err.Error())
-				continue
-			}
+	check.Store["host-systemd-check"] = &check.ExtensionCheck{SystemdCheck}
+	check.Store["host-coreos-check"] = &check.ExtensionCheck{CoreOSCheck}
 
-			metric.AddPoint(point)
+	for name, c := range map[string]*Check{
+		"files":   filesCheck,
+		"pids":    pidsCheck,
+		"entropy": entropyCheck,
+	} {
+		check.Store[fmt.Sprintf("host-%s-check", name)] = &check.ExtensionCheck{
+			c.Check,
+		}
+		check.Store[fmt.Sprintf("host-%s-metric", name)] = &check.ExtensionCheck{
+			c.Metric,
 		}
 	}
 
-	return metric.Render()
-}
-
-func main() {
-	cfg := sensu.NewConfigFromFlagSet(sensu.ExtractFlags())
-
-	t := rabbitmq.NewRabbitMQTransport(cfg.RabbitMQURI())
-	client := sensu.NewClient(t, cfg)
-
-	check.Store["host-mem-check"] = &check.ExtensionCheck{memCheck.Check}
-	check.Store["host-disk-check"] = &check.ExtensionCheck{diskCheck.Check}
-	check.Store["host-docker_vsz-check"] = &check.ExtensionCheck{
-		dockerVSZCheck.Check,
+	check.Store["host-clock-check"] = &check.ExtensionCheck{ClockCheck}
+	check.Store["host-clock-metric"] = &check.ExtensionCheck{
+		clockOffsetCheck.Metric,
 	}
-	check.Store["host-load_average-check"] = &check.ExtensionCheck{
-		loadAverageCheck.Check,
+
+	check.Store["host-network-metric"] = &check.ExtensionCheck{
+		HostNetworkMetric,
 	}
-	check.Store["host-mem-metric"] = &check.ExtensionCheck{memCheck.Metric}
-	check.Store["host-disk-metric"] = &check.ExtensionCheck{diskCheck.Metric}
-	check.Store["host-cpu-metric"] = &check.ExtensionCheck{cpuCheck.Metric}
-	check.Store["host-load_average-metric"] = &check.ExtensionCheck{
-		loadAverageCheck.Metric,
+	check.Store["host-conntrack-check"] = &check.ExtensionCheck{
+		conntrackCheck.Check,
 	}
-	check.Store["host-docker_vsz-metric"] = &check.ExtensionCheck{
-		dockerVSZCheck.Metric,
+	check.Store["host-conntrack-metric"] = &check.ExtensionCheck{
+		conntrackCheck.Metric,
 	}
 
 	check.Store["docker-containers-metric"] = &check.ExtensionCheck{
 		DockerContainersMetric,
 	}
+	check.Store["docker-containers-memory-check"] = &check.ExtensionCheck{
+		DockerContainersMemoryCheck,
+	}
+	check.Store["docker-containers-check"] = &check.ExtensionCheck{
+		DockerContainersCheck,
+	}
 
 	client.Start()
 }
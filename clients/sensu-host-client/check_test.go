@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCheckSustained(t *testing.T) {
+	value := 0.0
+	c := &Check{
+		Name:             "util",
+		errorThreshold:   &liveThreshold{value: absolute(90)},
+		warningThreshold: &liveThreshold{value: absolute(80)},
+		displayValue:     displayPercentage,
+		samples:          3,
+		fetchValue:       func() (float64, error) { return value, nil },
+	}
+
+	for i, tCase := range []struct {
+		value  float64
+		status int
+	}{
+		{95, statusOk},
+		{95, statusOk},
+		{95, statusError},
+		{85, statusWarning},
+		{50, statusOk},
+		{95, statusOk},
+		{95, statusOk},
+		{85, statusWarning},
+		{95, statusWarning},
+	} {
+		value = tCase.value
+
+		if status, message := c.evaluate(); status != tCase.status {
+			t.Errorf("sample %d: %d (%s), expected %d", i, status, message, tCase.status)
+		}
+	}
+}
+
+func TestCheckSigned(t *testing.T) {
+	c := &Check{
+		Name:             "clock_offset",
+		errorThreshold:   &liveThreshold{value: absolute(100)},
+		warningThreshold: &liveThreshold{value: absolute(50)},
+		displayValue:     func(v float64) string { return fmt.Sprintf("%.1fms", v) },
+		signed:           true,
+		fetchValue:       func() (float64, error) { return -150, nil },
+	}
+
+	if status, message := c.evaluate(); status != statusError {
+		t.Errorf("%d (%s), expected an error", status, message)
+	}
+
+	if output := c.Metric().Output; !strings.Contains(output, "clock_offset -150.") {
+		t.Errorf("%q, expected the signed offset", output)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/upfluence/sensu-client-go/sensu/check"
+)
+
+const (
+	DEFAULT_CLOCK_OFFSET_WARNING = 100
+	DEFAULT_CLOCK_OFFSET_ERROR   = 500
+	ntpTimeout                   = 5 * time.Second
+	// seconds between the NTP epoch (1900) and the unix epoch
+	ntpEpochOffset = 2208988800
+	// adjtimex status bits
+	staUnsync = 0x0040
+	staNano   = 0x2000
+)
+
+func ntpServer() string {
+	if server := os.Getenv("NTP_SERVER"); server != "" {
+		return server
+	}
+
+	server, _, _ := lookupKey(etcd.NewClient(etcdMachines()), "NTP_SERVER")
+
+	return server
+}
+
+func ntpTime(b []byte) time.Time {
+	seconds := binary.BigEndian.Uint32(b[0:4])
+	fraction := binary.BigEndian.Uint32(b[4:8])
+
+	return time.Unix(
+		int64(seconds)-ntpEpochOffset,
+		int64(fraction)*1e9>>32,
+	)
+}
+
+func putNtpTime(b []byte, t time.Time) {
+	binary.BigEndian.PutUint32(b[0:4], uint32(t.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(b[4:8], uint32(int64(t.Nanosecond())<<32/1e9))
+}
+
+// sntpOffset queries a SNTP server and returns the offset of the local clock
+// against it.
+func sntpOffset(server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+
+	conn, err := net.DialTimeout("udp", server, ntpTimeout)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(ntpTimeout))
+
+	request := make([]byte, 48)
+	// Leap indicator 0, version 4, client mode
+	request[0] = 0x23
+
+	sentAt := time.Now()
+	putNtpTime(request[40:48], sentAt)
+
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+
+	response := make([]byte, 48)
+
+	if n, err := conn.Read(response); err != nil {
+		return 0, err
+	} else if n < 48 {
+		return 0, fmt.Errorf("%s: short NTP response", server)
+	}
+
+	receivedAt := time.Now()
+
+	if response[1] == 0 {
+		return 0, fmt.Errorf("%s: kiss-o'-death NTP response", server)
+	}
+
+	// The originate timestamp echoes the transmit timestamp of the request
+	if !bytes.Equal(response[24:32], request[40:48]) {
+		return 0, fmt.Errorf("%s: NTP response to another request", server)
+	}
+
+	serverReceivedAt := ntpTime(response[32:40])
+	serverSentAt := ntpTime(response[40:48])
+
+	return (serverReceivedAt.Sub(sentAt) + serverSentAt.Sub(receivedAt)) / 2,
+		nil
+}
+
+// kernelClock returns whether the kernel considers its clock synchronized,
+// and the offset it is still correcting.
+func kernelClock() (bool, time.Duration, error) {
+	tx := syscall.Timex{}
+
+	if _, err := syscall.Adjtimex(&tx); err != nil {
+		return false, 0, err
+	}
+
+	offset := time.Duration(tx.Offset) * time.Microsecond
+
+	if tx.Status&staNano != 0 {
+		offset = time.Duration(tx.Offset)
+	}
+
+	return tx.Status&staUnsync == 0, offset, nil
+}
+
+// clockOffset is measured against NTP_SERVER when configured, and falls back
+// on the offset of the kernel. It is positive when the clock runs behind.
+func clockOffset() (float64, error) {
+	var offset time.Duration
+
+	if server := ntpServer(); server != "" {
+		o, err := sntpOffset(server)
+
+		if err != nil {
+			return 0.0, err
+		}
+
+		offset = o
+	} else {
+		_, o, err := kernelClock()
+
+		if err != nil {
+			return 0.0, err
+		}
+
+		offset = o
+	}
+
+	return offset.Seconds() * 1000, nil
+}
+
+var clockOffsetCheck = &Check{
+	Name: "clock_offset",
+	errorThreshold: fetchThreshold(
+		"CLOCK_OFFSET_ERROR",
+		absolute(DEFAULT_CLOCK_OFFSET_ERROR),
+	),
+	warningThreshold: fetchThreshold(
+		"CLOCK_OFFSET_WARNING",
+		absolute(DEFAULT_CLOCK_OFFSET_WARNING),
+	),
+	displayValue: func(v float64) string { return fmt.Sprintf("%.1fms", v) },
+	signed:       true,
+	fetchValue:   clockOffset,
+}
+
+func ClockCheck() check.ExtensionCheckResult {
+	status, message := clockOffsetCheck.evaluate()
+
+	if synchronized, _, err := kernelClock(); err != nil {
+		log.Println(err.Error())
+	} else if !synchronized && status < statusWarning {
+		status = statusWarning
+		message = fmt.Sprintf("%s, kernel clock not synchronized", message)
+	}
+
+	return render(status, message)
+}
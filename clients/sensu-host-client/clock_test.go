@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNTPServer answers a single SNTP request on localhost with the response
+// built by respond.
+func fakeNTPServer(t *testing.T, respond func([]byte) []byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer conn.Close()
+
+		request := make([]byte, 48)
+		conn.SetDeadline(time.Now().Add(ntpTimeout))
+
+		n, addr, err := conn.ReadFrom(request)
+
+		if err != nil {
+			return
+		}
+
+		conn.WriteTo(respond(request[:n]), addr)
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// shiftedResponse answers as a server whose clock is ahead by shift.
+func shiftedResponse(shift time.Duration) func([]byte) []byte {
+	return func(request []byte) []byte {
+		response := make([]byte, 48)
+		// Leap indicator 0, version 4, server mode
+		response[0] = 0x24
+		response[1] = 2
+		copy(response[24:32], request[40:48])
+		putNtpTime(response[32:40], time.Now().Add(shift))
+		putNtpTime(response[40:48], time.Now().Add(shift))
+
+		return response
+	}
+}
+
+func TestSntpOffset(t *testing.T) {
+	for _, shift := range []time.Duration{
+		250 * time.Millisecond,
+		-1500 * time.Millisecond,
+		0,
+	} {
+		offset, err := sntpOffset(fakeNTPServer(t, shiftedResponse(shift)))
+
+		if err != nil {
+			t.Errorf("%s: %s", shift, err.Error())
+			continue
+		}
+
+		if d := offset - shift; d > 50*time.Millisecond || d < -50*time.Millisecond {
+			t.Errorf("%s: offset %s", shift, offset)
+		}
+	}
+}
+
+func TestSntpOffsetErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		respond func([]byte) []byte
+		err     string
+	}{
+		{
+			name: "kiss-o'-death",
+			respond: func(request []byte) []byte {
+				response := shiftedResponse(0)(request)
+				response[1] = 0
+
+				return response
+			},
+			err: "kiss-o'-death",
+		},
+		{
+			name: "short",
+			respond: func(request []byte) []byte {
+				return shiftedResponse(0)(request)[:24]
+			},
+			err: "short NTP response",
+		},
+		{
+			name: "originate mismatch",
+			respond: func(request []byte) []byte {
+				response := shiftedResponse(0)(request)
+				putNtpTime(response[24:32], time.Now().Add(-time.Hour))
+
+				return response
+			},
+			err: "another request",
+		},
+	} {
+		_, err := sntpOffset(fakeNTPServer(t, tc.respond))
+
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/upfluence/sensu-client-go/sensu/check"
+	"github.com/upfluence/sensu-client-go/sensu/handler"
+)
+
+const (
+	DEFAULT_OS_RELEASE           = "/etc/os-release"
+	DEFAULT_UPDATE_ENGINE_CLIENT = "update_engine_client"
+	DEFAULT_MACHINES_NAMESPACE   = "machines"
+	updateStatusNeedReboot       = "UPDATE_STATUS_UPDATED_NEED_REBOOT"
+)
+
+func defaultEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return defaultValue
+}
+
+// readKeyValues parses the KEY=value lines of os-release and of the
+// update_engine_client status, stripping the quotes of the values.
+func readKeyValues(blob []byte) map[string]string {
+	result := make(map[string]string)
+
+	for _, line := range strings.Split(string(blob), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+
+		if len(kv) == 2 {
+			result[kv[0]] = strings.Trim(kv[1], `"'`)
+		}
+	}
+
+	return result
+}
+
+func osVersion() (string, error) {
+	blob, err := ioutil.ReadFile(defaultEnv("OS_RELEASE", DEFAULT_OS_RELEASE))
+
+	if err != nil {
+		return "", err
+	}
+
+	version, ok := readKeyValues(blob)["VERSION"]
+
+	if !ok {
+		return "", fmt.Errorf("No VERSION in os-release")
+	}
+
+	return version, nil
+}
+
+func updateEngineStatus() (map[string]string, error) {
+	command := strings.Fields(
+		defaultEnv("UPDATE_ENGINE_CLIENT", DEFAULT_UPDATE_ENGINE_CLIENT),
+	)
+
+	out, err := exec.Command(
+		command[0],
+		append(command[1:], "-status")...,
+	).Output()
+
+	if err != nil {
+		return nil, fmt.Errorf("update_engine_client: %s", err.Error())
+	}
+
+	return readKeyValues(out), nil
+}
+
+// clusterVersion returns the OS version run by a strict majority of the
+// machines registered by export_infos.sh, nothing when no version is, such as
+// in the middle of a rolling update.
+func clusterVersion() (string, error) {
+	resp, err := etcd.NewClient(etcdMachines()).Get(
+		fmt.Sprintf(
+			"/%s",
+			defaultEnv("ETCD_NAMESPACE", DEFAULT_MACHINES_NAMESPACE),
+		),
+		false,
+		true,
+	)
+
+	if err != nil {
+		return "", err
+	}
+
+	counts := make(map[string]int)
+
+	for _, machine := range resp.Node.Nodes {
+		for _, n := range machine.Nodes {
+			if strings.HasSuffix(n.Key, "/version") {
+				counts[n.Value]++
+			}
+		}
+	}
+
+	return majorityVersion(counts), nil
+}
+
+// majorityVersion returns the version counted more than half of the time.
+func majorityVersion(counts map[string]int) string {
+	total := 0
+
+	for _, count := range counts {
+		total += count
+	}
+
+	for version, count := range counts {
+		if 2*count > total {
+			return version
+		}
+	}
+
+	return ""
+}
+
+// CoreOSCheck warns when an update has been downloaded and waits for a reboot,
+// or when the host runs another version than most of the cluster.
+func CoreOSCheck() check.ExtensionCheckResult {
+	version, err := osVersion()
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	status, err := updateEngineStatus()
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	majority, err := clusterVersion()
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	messages := []string{}
+
+	if status["CURRENT_OP"] == updateStatusNeedReboot {
+		messages = append(
+			messages,
+			fmt.Sprintf(
+				"Reboot pending to update from %s to %s",
+				version,
+				status["NEW_VERSION"],
+			),
+		)
+	}
+
+	if majority != "" && majority != version {
+		messages = append(
+			messages,
+			fmt.Sprintf(
+				"Running %s while most of the cluster runs %s",
+				version,
+				majority,
+			),
+		)
+	}
+
+	if len(messages) > 0 {
+		return handler.Warning(strings.Join(messages, ", "))
+	}
+
+	return handler.Ok(fmt.Sprintf("Running %s, up to date", version))
+}
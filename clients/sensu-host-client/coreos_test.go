@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestMajorityVersion(t *testing.T) {
+	for _, tCase := range []struct {
+		counts   map[string]int
+		majority string
+	}{
+		{map[string]int{}, ""},
+		{map[string]int{"1068.6.0": 3}, "1068.6.0"},
+		{map[string]int{"1068.6.0": 3, "1068.8.0": 2}, "1068.6.0"},
+		{map[string]int{"1068.6.0": 2, "1068.8.0": 2}, ""},
+		{map[string]int{"1068.6.0": 2, "1068.8.0": 1, "1068.9.0": 1}, ""},
+	} {
+		if majority := majorityVersion(tCase.counts); majority != tCase.majority {
+			t.Errorf("%v: %q, expected %q", tCase.counts, majority, tCase.majority)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gosigar"
+	"github.com/upfluence/sensu-client-go/sensu/check"
+	"github.com/upfluence/sensu-client-go/sensu/handler"
+)
+
+const (
+	DEFAULT_CPU_WARNING        = 85
+	DEFAULT_CPU_ERROR          = 95
+	DEFAULT_CPU_IOWAIT_WARNING = 20
+	DEFAULT_CPU_IOWAIT_ERROR   = 40
+	DEFAULT_CPU_STEAL_WARNING  = 10
+	DEFAULT_CPU_STEAL_ERROR    = 25
+	cpuSampleInterval          = 5 * time.Second
+)
+
+// cpuPercentages is the share of time spent in each mode between two samples
+// of the cpu counters.
+type cpuPercentages struct {
+	user, nice, system, iowait, irq, softirq, steal, idle float64
+}
+
+func newCpuPercentages(previous, current sigar.Cpu) cpuPercentages {
+	delta := func(p, c uint64) float64 {
+		if c < p {
+			return 0.0
+		}
+
+		return float64(c - p)
+	}
+
+	p := cpuPercentages{
+		user:    delta(previous.User, current.User),
+		nice:    delta(previous.Nice, current.Nice),
+		system:  delta(previous.Sys, current.Sys),
+		iowait:  delta(previous.Wait, current.Wait),
+		irq:     delta(previous.Irq, current.Irq),
+		softirq: delta(previous.SoftIrq, current.SoftIrq),
+		steal:   delta(previous.Stolen, current.Stolen),
+		idle:    delta(previous.Idle, current.Idle),
+	}
+
+	total := p.user + p.nice + p.system + p.iowait + p.irq + p.softirq +
+		p.steal + p.idle
+
+	if total == 0 {
+		return cpuPercentages{}
+	}
+
+	return cpuPercentages{
+		user:    100 * p.user / total,
+		nice:    100 * p.nice / total,
+		system:  100 * p.system / total,
+		iowait:  100 * p.iowait / total,
+		irq:     100 * p.irq / total,
+		softirq: 100 * p.softirq / total,
+		steal:   100 * p.steal / total,
+		idle:    100 * p.idle / total,
+	}
+}
+
+// busy is the time actually spent running code, iowait and steal are
+// reported on their own.
+func (p cpuPercentages) busy() float64 {
+	return p.user + p.nice + p.system + p.irq + p.softirq
+}
+
+func (p cpuPercentages) values() map[string]float64 {
+	return map[string]float64{
+		"user":    p.user,
+		"nice":    p.nice,
+		"system":  p.system,
+		"iowait":  p.iowait,
+		"irq":     p.irq,
+		"softirq": p.softirq,
+		"steal":   p.steal,
+		"idle":    p.idle,
+		"busy":    p.busy(),
+	}
+}
+
+// cpuSample is shared by the cpu checks and metric so that a run only waits
+// for a single sampling interval.
+var cpuSample = struct {
+	sync.Mutex
+	at    time.Time
+	total cpuPercentages
+	cores []cpuPercentages
+}{}
+
+func sampleCpu() (cpuPercentages, []cpuPercentages, error) {
+	cpuSample.Lock()
+	defer cpuSample.Unlock()
+
+	if time.Since(cpuSample.at) < cpuSampleInterval {
+		return cpuSample.total, cpuSample.cores, nil
+	}
+
+	previous, previousCores := sigar.Cpu{}, sigar.CpuList{}
+
+	if err := previous.Get(); err != nil {
+		return cpuPercentages{}, nil, err
+	}
+
+	if err := previousCores.Get(); err != nil {
+		return cpuPercentages{}, nil, err
+	}
+
+	time.Sleep(cpuSampleInterval)
+
+	current, currentCores := sigar.Cpu{}, sigar.CpuList{}
+
+	if err := current.Get(); err != nil {
+		return cpuPercentages{}, nil, err
+	}
+
+	if err := currentCores.Get(); err != nil {
+		return cpuPercentages{}, nil, err
+	}
+
+	cores := []cpuPercentages{}
+
+	for i, c := range currentCores.List {
+		if i < len(previousCores.List) {
+			cores = append(cores, newCpuPercentages(previousCores.List[i], c))
+		}
+	}
+
+	cpuSample.at = time.Now()
+	cpuSample.total = newCpuPercentages(previous, current)
+	cpuSample.cores = cores
+
+	return cpuSample.total, cpuSample.cores, nil
+}
+
+func CpuMetric() check.ExtensionCheckResult {
+	metric := &handler.Metric{}
+
+	total, cores, err := sampleCpu()
+
+	if err != nil {
+		log.Println(err.Error())
+
+		return metric.Render()
+	}
+
+	for mode, v := range total.values() {
+		metric.AddPoint(
+			&handler.Point{
+				fmt.Sprintf("%s.cpu.%s", os.Getenv("SENSU_HOSTNAME"), mode),
+				v,
+			},
+		)
+	}
+
+	for i, core := range cores {
+		for mode, v := range core.values() {
+			metric.AddPoint(
+				&handler.Point{
+					fmt.Sprintf(
+						"%s.cpu.core%d.%s",
+						os.Getenv("SENSU_HOSTNAME"),
+						i,
+						mode,
+					),
+					v,
+				},
+			)
+		}
+	}
+
+	return metric.Render()
+}
+
+func displayPercentage(v float64) string {
+	return fmt.Sprintf("%.1f%%", v)
+}
+
+func cpuCheck(
+	mode string,
+	key string,
+	errorThreshold, warningThreshold float64,
+) *Check {
+	return &Check{
+		Name: fmt.Sprintf("cpu.%s", mode),
+		errorThreshold: fetchThreshold(
+			fmt.Sprintf("%s_ERROR", key),
+			absolute(errorThreshold),
+		),
+		warningThreshold: fetchThreshold(
+			fmt.Sprintf("%s_WARNING", key),
+			absolute(warningThreshold),
+		),
+		displayValue: displayPercentage,
+		percentValue: true,
+		fetchValue: func() (float64, error) {
+			total, _, err := sampleCpu()
+
+			if err != nil {
+				return 0.0, err
+			}
+
+			return total.values()[mode], nil
+		},
+	}
+}
+
+var cpuChecks = checkGroup{
+	cpuCheck("busy", "CPU", DEFAULT_CPU_ERROR, DEFAULT_CPU_WARNING),
+	cpuCheck(
+		"iowait",
+		"CPU_IOWAIT",
+		DEFAULT_CPU_IOWAIT_ERROR,
+		DEFAULT_CPU_IOWAIT_WARNING,
+	),
+	cpuCheck(
+		"steal",
+		"CPU_STEAL",
+		DEFAULT_CPU_STEAL_ERROR,
+		DEFAULT_CPU_STEAL_WARNING,
+	),
+}
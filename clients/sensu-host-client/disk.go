@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/cloudfoundry/gosigar"
+)
+
+var pseudoFileSystems = map[string]bool{
+	"tmpfs":       true,
+	"devtmpfs":    true,
+	"overlay":     true,
+	"aufs":        true,
+	"proc":        true,
+	"sysfs":       true,
+	"cgroup":      true,
+	"cgroup2":     true,
+	"devpts":      true,
+	"mqueue":      true,
+	"debugfs":     true,
+	"securityfs":  true,
+	"pstore":      true,
+	"autofs":      true,
+	"hugetlbfs":   true,
+	"configfs":    true,
+	"fusectl":     true,
+	"selinuxfs":   true,
+	"tracefs":     true,
+	"nsfs":        true,
+	"binfmt_misc": true,
+}
+
+var mountNameReplacer = strings.NewReplacer("/", "_", ".", "_")
+
+func mountName(dir string) string {
+	if dir == "/" {
+		return "root"
+	}
+
+	return mountNameReplacer.Replace(strings.Trim(dir, "/"))
+}
+
+func isReadOnly(fs sigar.FileSystem) bool {
+	for _, opt := range strings.Split(fs.Options, ",") {
+		if opt == "ro" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mountedFileSystems lists the real, writable filesystems of the host. Bind
+// mounts of an already listed device (docker's /etc/hosts and friends) are
+// skipped so that every device is only checked once.
+func mountedFileSystems() []sigar.FileSystem {
+	fsList := sigar.FileSystemList{}
+
+	if err := fsList.Get(); err != nil {
+		log.Println(err.Error())
+
+		return []sigar.FileSystem{{DirName: "/"}}
+	}
+
+	devices := make(map[string]int)
+	result := []sigar.FileSystem{}
+
+	for _, fs := range fsList.List {
+		if pseudoFileSystems[fs.SysTypeName] || isReadOnly(fs) {
+			continue
+		}
+
+		if i, ok := devices[fs.DevName]; ok {
+			if len(fs.DirName) < len(result[i].DirName) {
+				result[i] = fs
+			}
+
+			continue
+		}
+
+		devices[fs.DevName] = len(result)
+		result = append(result, fs)
+	}
+
+	return result
+}
+
+func fileSystemUsage(dir string) (sigar.FileSystemUsage, error) {
+	usage, err := sgr.GetFileSystemUsage(dir)
+
+	if err != nil {
+		return usage, fmt.Errorf("%s: %s", dir, err.Error())
+	}
+
+	return usage, nil
+}
+
+// diskThresholdKey returns the key of the threshold of a mount point, a child
+// of the setting so that every mount point can be configured alongside "/".
+func diskThresholdKey(setting, dir string) string {
+	if dir == "/" {
+		return path.Join(setting, mountName(dir))
+	}
+
+	return path.Join(setting, dir)
+}
+
+func diskCheck(fs sigar.FileSystem) *Check {
+	var errorFallback, warningFallback []string
+	errorThreshold := percentage(DEFAULT_DISK_PERCENT_ERROR)
+	warningThreshold := percentage(DEFAULT_DISK_PERCENT_WARNING)
+
+	if fs.DirName == "/" {
+		errorThreshold = absolute(DEFAULT_DISK_ERROR)
+		warningThreshold = absolute(DEFAULT_DISK_WARNING)
+		// "/" used to be configured by the plain DISK_ERROR and DISK_WARNING
+		errorFallback = []string{"DISK_ERROR"}
+		warningFallback = []string{"DISK_WARNING"}
+	}
+
+	return &Check{
+		Name: fmt.Sprintf("disk.%s", mountName(fs.DirName)),
+		errorThreshold: fetchThreshold(
+			diskThresholdKey("DISK_ERROR", fs.DirName),
+			errorThreshold,
+			errorFallback...,
+		),
+		warningThreshold: fetchThreshold(
+			diskThresholdKey("DISK_WARNING", fs.DirName),
+			warningThreshold,
+			warningFallback...,
+		),
+		displayValue: displayBytes,
+		fetchValue: func() (float64, error) {
+			v, err := fileSystemUsage(fs.DirName)
+
+			if err != nil {
+				return 0.0, err
+			}
+
+			return float64(v.Used * 1024), nil
+		},
+		fetchTotal: func() (float64, error) {
+			v, err := fileSystemUsage(fs.DirName)
+
+			if err != nil {
+				return 0.0, err
+			}
+
+			// Same as df: blocks reserved to root are not usable
+			return float64((v.Used + v.Avail) * 1024), nil
+		},
+	}
+}
+
+func inodeCheck(fs sigar.FileSystem) *Check {
+	return &Check{
+		Name: fmt.Sprintf("disk_inodes.%s", mountName(fs.DirName)),
+		errorThreshold: fetchThreshold(
+			diskThresholdKey("DISK_INODES_ERROR", fs.DirName),
+			percentage(DEFAULT_INODES_ERROR),
+		),
+		warningThreshold: fetchThreshold(
+			diskThresholdKey("DISK_INODES_WARNING", fs.DirName),
+			percentage(DEFAULT_INODES_WARNING),
+		),
+		displayValue: func(v float64) string { return fmt.Sprintf("%.0f inodes", v) },
+		fetchValue: func() (float64, error) {
+			v, err := fileSystemUsage(fs.DirName)
+
+			if err != nil {
+				return 0.0, err
+			}
+
+			return float64(v.Files - v.FreeFiles), nil
+		},
+		fetchTotal: func() (float64, error) {
+			v, err := fileSystemUsage(fs.DirName)
+
+			if err != nil {
+				return 0.0, err
+			}
+
+			return float64(v.Files), nil
+		},
+	}
+}
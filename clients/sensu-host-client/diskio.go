@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/upfluence/sensu-client-go/sensu/check"
+	"github.com/upfluence/sensu-client-go/sensu/handler"
+)
+
+const (
+	DEFAULT_DISK_UTIL_WARNING  = 80
+	DEFAULT_DISK_UTIL_ERROR    = 95
+	DEFAULT_DISK_AWAIT_WARNING = 50
+	DEFAULT_DISK_AWAIT_ERROR   = 200
+	DEFAULT_DISKIO_SAMPLES     = 3
+	diskSampleInterval         = 5 * time.Second
+	sectorSize                 = 512
+)
+
+// diskCounters are the cumulative counters of a /proc/diskstats line.
+type diskCounters struct {
+	reads, sectorsRead, msReading   float64
+	writes, sectorsWritten, msWrite float64
+	msIO, weightedMsIO              float64
+}
+
+// diskRates are the activity of a device between two samples.
+type diskRates struct {
+	readIOPS, writeIOPS   float64
+	readBytes, writeBytes float64
+	await                 float64
+	queue                 float64
+	util                  float64
+}
+
+func (r *diskRates) values() map[string]float64 {
+	return map[string]float64{
+		"read_iops":   r.readIOPS,
+		"write_iops":  r.writeIOPS,
+		"read_bytes":  r.readBytes,
+		"write_bytes": r.writeBytes,
+		"await":       r.await,
+		"queue":       r.queue,
+		"util":        r.util,
+	}
+}
+
+// sysRoot is the sysfs of the host, mounted next to its procfs.
+func sysRoot() string {
+	if root := os.Getenv("SYS_ROOT"); root != "" {
+		return root
+	}
+
+	return filepath.Join(filepath.Dir(procRoot()), "sys")
+}
+
+// isWholeDisk filters out partitions and virtual devices, the kernel only
+// lists whole devices under /sys/block.
+func isWholeDisk(name string) bool {
+	if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+		return false
+	}
+
+	_, err := os.Stat(filepath.Join(sysRoot(), "block", name))
+
+	return !os.IsNotExist(err)
+}
+
+func readDiskStats() (map[string]*diskCounters, error) {
+	f, err := os.Open(filepath.Join(procRoot(), "diskstats"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	result := make(map[string]*diskCounters)
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) < 14 || !isWholeDisk(fields[2]) {
+			continue
+		}
+
+		values := make([]float64, 11)
+
+		for i := range values {
+			if values[i], err = strconv.ParseFloat(fields[i+3], 64); err != nil {
+				return nil, err
+			}
+		}
+
+		result[fields[2]] = &diskCounters{
+			reads:          values[0],
+			sectorsRead:    values[2],
+			msReading:      values[3],
+			writes:         values[4],
+			sectorsWritten: values[6],
+			msWrite:        values[7],
+			msIO:           values[9],
+			weightedMsIO:   values[10],
+		}
+	}
+
+	return result, scanner.Err()
+}
+
+func newDiskRates(previous, current *diskCounters, d time.Duration) *diskRates {
+	seconds := d.Seconds()
+	reads := current.reads - previous.reads
+	writes := current.writes - previous.writes
+	rates := &diskRates{
+		readIOPS:   reads / seconds,
+		writeIOPS:  writes / seconds,
+		readBytes:  (current.sectorsRead - previous.sectorsRead) * sectorSize / seconds,
+		writeBytes: (current.sectorsWritten - previous.sectorsWritten) * sectorSize / seconds,
+		queue:      (current.weightedMsIO - previous.weightedMsIO) / (seconds * 1000),
+		util:       100 * (current.msIO - previous.msIO) / (seconds * 1000),
+	}
+
+	if reads+writes > 0 {
+		rates.await = (current.msReading - previous.msReading +
+			current.msWrite - previous.msWrite) / (reads + writes)
+	}
+
+	return rates
+}
+
+// diskSample is shared by the disk I/O checks and metric so that a run only
+// waits for a single sampling interval.
+var diskSample = struct {
+	sync.Mutex
+	at    time.Time
+	rates map[string]*diskRates
+}{}
+
+func sampleDisks() (map[string]*diskRates, error) {
+	diskSample.Lock()
+	defer diskSample.Unlock()
+
+	if time.Since(diskSample.at) < diskSampleInterval {
+		return diskSample.rates, nil
+	}
+
+	previous, err := readDiskStats()
+
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	time.Sleep(diskSampleInterval)
+
+	current, err := readDiskStats()
+
+	if err != nil {
+		return nil, err
+	}
+
+	elapsed := time.Since(start)
+	rates := make(map[string]*diskRates)
+
+	for name, c := range current {
+		if p, ok := previous[name]; ok {
+			rates[name] = newDiskRates(p, c, elapsed)
+		}
+	}
+
+	diskSample.at = time.Now()
+	diskSample.rates = rates
+
+	return rates, nil
+}
+
+func diskRate(device, name string) func() (float64, error) {
+	return func() (float64, error) {
+		rates, err := sampleDisks()
+
+		if err != nil {
+			return 0.0, err
+		}
+
+		r, ok := rates[device]
+
+		if !ok {
+			return 0.0, fmt.Errorf("%s: device not found", device)
+		}
+
+		return r.values()[name], nil
+	}
+}
+
+// diskIOChecks only fail once DEFAULT_DISKIO_SAMPLES consecutive samples
+// exceeded a threshold. The thresholds of a device are read under
+// DISK_UTIL_ERROR/<device> and alike, falling back to the DISKIO_UTIL_ERROR
+// and alike settings of every device.
+func diskIOChecks(device string) checkGroup {
+	return checkGroup{
+		&Check{
+			Name: fmt.Sprintf("diskio.%s.util", device),
+			errorThreshold: fetchThreshold(
+				path.Join("DISK_UTIL_ERROR", device),
+				absolute(DEFAULT_DISK_UTIL_ERROR),
+				"DISKIO_UTIL_ERROR",
+			),
+			warningThreshold: fetchThreshold(
+				path.Join("DISK_UTIL_WARNING", device),
+				absolute(DEFAULT_DISK_UTIL_WARNING),
+				"DISKIO_UTIL_WARNING",
+			),
+			displayValue: displayPercentage,
+			percentValue: true,
+			samples:      DEFAULT_DISKIO_SAMPLES,
+			fetchValue:   diskRate(device, "util"),
+		},
+		&Check{
+			Name: fmt.Sprintf("diskio.%s.await", device),
+			errorThreshold: fetchThreshold(
+				path.Join("DISK_AWAIT_ERROR", device),
+				absolute(DEFAULT_DISK_AWAIT_ERROR),
+				"DISKIO_AWAIT_ERROR",
+			),
+			warningThreshold: fetchThreshold(
+				path.Join("DISK_AWAIT_WARNING", device),
+				absolute(DEFAULT_DISK_AWAIT_WARNING),
+				"DISKIO_AWAIT_WARNING",
+			),
+			displayValue: func(v float64) string { return fmt.Sprintf("%.1fms", v) },
+			samples:      DEFAULT_DISKIO_SAMPLES,
+			fetchValue:   diskRate(device, "await"),
+		},
+	}
+}
+
+// blockDevices lists the devices known when the client starts.
+func blockDevices() []string {
+	stats, err := readDiskStats()
+
+	if err != nil {
+		log.Println(err.Error())
+
+		return nil
+	}
+
+	devices := []string{}
+
+	for name := range stats {
+		devices = append(devices, name)
+	}
+
+	return devices
+}
+
+func DiskIOMetric() check.ExtensionCheckResult {
+	metric := &handler.Metric{}
+
+	rates, err := sampleDisks()
+
+	if err != nil {
+		log.Println(err.Error())
+
+		return metric.Render()
+	}
+
+	for device, r := range rates {
+		for name, v := range r.values() {
+			metric.AddPoint(
+				&handler.Point{
+					fmt.Sprintf(
+						"%s.diskio.%s.%s",
+						os.Getenv("SENSU_HOSTNAME"),
+						device,
+						name,
+					),
+					v,
+				},
+			)
+		}
+	}
+
+	return metric.Render()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadDiskStats(t *testing.T) {
+	os.Setenv("PROC_ROOT", filepath.Join("testdata", "proc"))
+	defer os.Unsetenv("PROC_ROOT")
+
+	stats, err := readDiskStats()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats) != 1 || stats["sda"] == nil {
+		t.Fatalf("%v, expected the sda whole disk only", stats)
+	}
+
+	expected := diskCounters{
+		reads:          1000,
+		sectorsRead:    20000,
+		msReading:      500,
+		writes:         2000,
+		sectorsWritten: 40000,
+		msWrite:        1500,
+		msIO:           1800,
+		weightedMsIO:   2000,
+	}
+
+	if *stats["sda"] != expected {
+		t.Errorf("%+v, expected %+v", *stats["sda"], expected)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/upfluence/sensu-client-go/sensu/check"
+	"github.com/upfluence/sensu-client-go/sensu/handler"
+)
+
+const (
+	DEFAULT_CONTAINER_MEM_WARNING = 85
+	DEFAULT_CONTAINER_MEM_ERROR   = 95
+)
+
+func newDockerClient() (*docker.Client, error) {
+	endpoint := os.Getenv("DOCKER_ENDPOINT")
+
+	if endpoint == "" {
+		endpoint = DOCKER_ENDPOINT
+	}
+
+	return docker.NewClient(endpoint)
+}
+
+func cgroupRoot() string {
+	if root := os.Getenv("CGROUP_ROOT"); root != "" {
+		return root
+	}
+
+	return CGROUP_ROOT
+}
+
+func containerName(container docker.APIContainers) string {
+	name := container.Names[0]
+
+	return name[1:len(name)]
+}
+
+// containerValues reads every containerStats of a container, indexed by stat
+// name.
+func containerValues(
+	h *cgroupHierarchy,
+	container docker.APIContainers,
+) map[string]float64 {
+	values := make(map[string]float64)
+
+	for _, stat := range containerStats {
+		v, err := stat.fetch(h, container.ID)
+
+		if err == errUnlimited {
+			continue
+		} else if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		values[stat.name] = v
+	}
+
+	if limit, ok := values["memory_limit"]; ok && limit > 0 {
+		values["memory_percent"] = 100 * values["memory_working_set"] / limit
+	}
+
+	return values
+}
+
+// containerNetworkValues sums the traffic of every interface but the loopback
+// in the network namespace of the container. Containers sharing the network
+// namespace of the host have no traffic of their own and report nothing.
+func containerNetworkValues(
+	client *docker.Client,
+	container docker.APIContainers,
+) (map[string]float64, error) {
+	c, err := client.InspectContainer(container.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if c.HostConfig != nil && c.HostConfig.NetworkMode == "host" {
+		return map[string]float64{}, nil
+	}
+
+	if c.State.Pid == 0 {
+		return nil, fmt.Errorf("%s: not running", containerName(container))
+	}
+
+	interfaces, err := readNetDev(
+		fmt.Sprintf("%s/%d/net/dev", procRoot(), c.State.Pid),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]float64{"network_rx": 0.0, "network_tx": 0.0}
+
+	for name, stats := range interfaces {
+		if name == "lo" {
+			continue
+		}
+
+		values["network_rx"] += stats.rxBytes
+		values["network_tx"] += stats.txBytes
+	}
+
+	return values, nil
+}
+
+func DockerContainersMetric() check.ExtensionCheckResult {
+	metric := handler.Metric{}
+
+	client, err := newDockerClient()
+
+	if err != nil {
+		log.Println(err.Error())
+
+		return metric.Render()
+	}
+
+	cs, err := client.ListContainers(docker.ListContainersOptions{})
+
+	if err != nil {
+		log.Println(err.Error())
+
+		return metric.Render()
+	}
+
+	h := newCgroupHierarchy(cgroupRoot())
+
+	for _, container := range cs {
+		values := containerValues(h, container)
+
+		if network, err := containerNetworkValues(client, container); err != nil {
+			log.Println(err.Error())
+		} else {
+			for k, v := range network {
+				values[k] = v
+			}
+		}
+
+		for name, v := range values {
+			metric.AddPoint(
+				&handler.Point{
+					fmt.Sprintf(
+						"docker.containers.%s.%s.%s",
+						os.Getenv("SENSU_HOSTNAME"),
+						containerName(container),
+						name,
+					),
+					v,
+				},
+			)
+		}
+	}
+
+	return metric.Render()
+}
+
+var (
+	containerMemErrorThreshold = fetchThreshold(
+		"CONTAINER_MEM_ERROR",
+		percentage(DEFAULT_CONTAINER_MEM_ERROR),
+	)
+	containerMemWarningThreshold = fetchThreshold(
+		"CONTAINER_MEM_WARNING",
+		percentage(DEFAULT_CONTAINER_MEM_WARNING),
+	)
+)
+
+func containerMemoryCheck(
+	h *cgroupHierarchy,
+	container docker.APIContainers,
+) *Check {
+	fetch := func(name string) func() (float64, error) {
+		return func() (float64, error) {
+			for _, stat := range containerStats {
+				if stat.name == name {
+					return stat.fetch(h, container.ID)
+				}
+			}
+
+			return 0.0, fmt.Errorf("Unknown stat %s", name)
+		}
+	}
+
+	return &Check{
+		Name:             fmt.Sprintf("%s.memory", containerName(container)),
+		errorThreshold:   containerMemErrorThreshold,
+		warningThreshold: containerMemWarningThreshold,
+		displayValue:     displayBytes,
+		fetchValue:       fetch("memory_working_set"),
+		fetchTotal:       fetch("memory_limit"),
+	}
+}
+
+// DockerContainersMemoryCheck warns about the containers nearing their memory
+// limit, containers without limit are ignored.
+func DockerContainersMemoryCheck() check.ExtensionCheckResult {
+	client, err := newDockerClient()
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	cs, err := client.ListContainers(docker.ListContainersOptions{})
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	h := newCgroupHierarchy(cgroupRoot())
+	checks := checkGroup{}
+
+	for _, container := range cs {
+		c := containerMemoryCheck(h, container)
+
+		if _, err := c.fetchTotal(); err == errUnlimited {
+			continue
+		}
+
+		checks = append(checks, c)
+	}
+
+	if len(checks) == 0 {
+		return handler.Ok("No container with a memory limit")
+	}
+
+	return checks.Check()
+}
+
+// restartCounts keeps the RestartCount of every container seen by the
+// previous DockerContainersCheck run, and when it ran.
+var restartCounts = struct {
+	sync.Mutex
+	counts    map[string]int
+	checkedAt time.Time
+}{counts: make(map[string]int)}
+
+// containersAllowlist returns the regexp of the containers ignored by
+// DockerContainersCheck, nil if every container is checked.
+func containersAllowlist() (*regexp.Regexp, error) {
+	value := os.Getenv("CONTAINERS_ALLOWLIST_REGEXP")
+
+	if value == "" {
+		value, _, _ = lookupKey(
+			etcd.NewClient(etcdMachines()),
+			"CONTAINERS_ALLOWLIST_REGEXP",
+		)
+	}
+
+	if value == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile(value)
+}
+
+// failedExit returns whether a stopped container exited on its own failure,
+// while its restart policy expects it to be running. The 143 and 137 exit
+// codes are the SIGTERM and SIGKILL of docker stop, other signals such as a
+// SIGSEGV or a SIGABRT are crashes.
+func failedExit(c *docker.Container) bool {
+	if c.State.Running || c.State.Restarting {
+		return false
+	}
+
+	switch c.State.ExitCode {
+	case 0, 128 + 9, 128 + 15:
+		return false
+	}
+
+	if c.HostConfig == nil {
+		return false
+	}
+
+	switch c.HostConfig.RestartPolicy.Name {
+	case "", "no":
+		return false
+	default:
+		return true
+	}
+}
+
+// recentOOMKill returns whether the OOM killer stopped the container since the
+// previous run. A stopped container keeps its OOMKilled flag until it starts
+// again, only the running and restarting ones are reported on the first run.
+func recentOOMKill(c *docker.Container, since time.Time) bool {
+	if !c.State.OOMKilled {
+		return false
+	}
+
+	if c.State.Running || c.State.Restarting {
+		return true
+	}
+
+	return !since.IsZero() && c.State.FinishedAt.After(since)
+}
+
+func formatContainers(title string, containers []string) string {
+	sort.Strings(containers)
+
+	return fmt.Sprintf("%s: %s", title, strings.Join(containers, ","))
+}
+
+// DockerContainersCheck reports the containers failing their HEALTHCHECK,
+// killed by the OOM killer, restarting since the previous run or exited on a
+// failure while they should be running.
+func DockerContainersCheck() check.ExtensionCheckResult {
+	allowlist, err := containersAllowlist()
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	client, err := newDockerClient()
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	cs, err := client.ListContainers(docker.ListContainersOptions{All: true})
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	var unhealthy, restarting, oomKilled, exited []string
+
+	restartCounts.Lock()
+	defer restartCounts.Unlock()
+
+	counts := make(map[string]int)
+	checkedAt := time.Now()
+
+	for _, container := range cs {
+		name := containerName(container)
+
+		if allowlist != nil && allowlist.MatchString(name) {
+			continue
+		}
+
+		c, err := client.InspectContainer(container.ID)
+
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		counts[c.ID] = c.RestartCount
+
+		previous, ok := restartCounts.counts[c.ID]
+
+		if c.State.Restarting || (ok && c.RestartCount > previous) {
+			restarting = append(
+				restarting,
+				fmt.Sprintf("%s (%d restarts)", name, c.RestartCount),
+			)
+		}
+
+		if c.State.Health.Status == "unhealthy" {
+			unhealthy = append(unhealthy, name)
+		}
+
+		if recentOOMKill(c, restartCounts.checkedAt) {
+			oomKilled = append(oomKilled, name)
+		}
+
+		if failedExit(c) {
+			exited = append(
+				exited,
+				fmt.Sprintf("%s (code %d)", name, c.State.ExitCode),
+			)
+		}
+	}
+
+	restartCounts.counts = counts
+	restartCounts.checkedAt = checkedAt
+
+	messages := []string{}
+
+	if len(unhealthy) > 0 {
+		messages = append(messages, formatContainers("Unhealthy", unhealthy))
+	}
+
+	if len(restarting) > 0 {
+		messages = append(messages, formatContainers("Restarting", restarting))
+	}
+
+	if len(oomKilled) > 0 {
+		messages = append(messages, formatContainers("OOM killed", oomKilled))
+	}
+
+	if len(exited) > 0 {
+		messages = append(messages, formatContainers("Exited", exited))
+	}
+
+	switch {
+	case len(unhealthy)+len(restarting)+len(oomKilled) > 0:
+		return handler.Error(strings.Join(messages, "; "))
+	case len(exited) > 0:
+		return handler.Warning(strings.Join(messages, "; "))
+	default:
+		return handler.Ok("Every containers are healthy")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Every layout holds the same values, v2 ones in microseconds
+var expectedContainerValues = map[string]float64{
+	"memory":                104857600,
+	"memory_working_set":    73400320,
+	"memory_rss":            52428800,
+	"memory_cache":          41943040,
+	"cpuacct":               123000,
+	"cpu_throttled_periods": 4,
+	"cpu_throttled_time":    5000,
+	"blkio_read":            110,
+	"blkio_write":           220,
+}
+
+// The systemd layouts run the container with a 200MB memory limit
+var limitedLayouts = map[string]bool{"v1-systemd": true, "v2-systemd": true}
+
+func TestContainerValues(t *testing.T) {
+	for _, layout := range cgroupLayouts {
+		h := newCgroupHierarchy(filepath.Join("testdata", "cgroup", layout.name))
+		expected := make(map[string]float64)
+
+		for k, v := range expectedContainerValues {
+			expected[k] = v
+		}
+
+		if limitedLayouts[layout.name] {
+			expected["memory_limit"] = 209715200
+			expected["memory_percent"] = 35
+		}
+
+		values := containerValues(
+			h,
+			docker.APIContainers{ID: fixtureContainerID, Names: []string{"/app"}},
+		)
+
+		if !reflect.DeepEqual(values, expected) {
+			t.Errorf("%s: %v, expected %v", layout.name, values, expected)
+		}
+	}
+}
+
+func TestFailedExit(t *testing.T) {
+	always := &docker.HostConfig{RestartPolicy: docker.RestartPolicy{Name: "always"}}
+
+	for _, tCase := range []struct {
+		state      docker.State
+		hostConfig *docker.HostConfig
+		failed     bool
+	}{
+		{docker.State{Running: true}, always, false},
+		{docker.State{Restarting: true, ExitCode: 1}, always, false},
+		{docker.State{ExitCode: 0}, always, false},
+		{docker.State{ExitCode: 1}, always, true},
+		{docker.State{ExitCode: 1}, &docker.HostConfig{}, false},
+		{docker.State{ExitCode: 1}, nil, false},
+		{docker.State{ExitCode: 137}, always, false},
+		{docker.State{ExitCode: 143}, always, false},
+		{docker.State{ExitCode: 134}, always, true},
+		{docker.State{ExitCode: 139}, always, true},
+	} {
+		c := &docker.Container{State: tCase.state, HostConfig: tCase.hostConfig}
+
+		if failed := failedExit(c); failed != tCase.failed {
+			t.Errorf("%+v: %v, expected %v", tCase.state, failed, tCase.failed)
+		}
+	}
+}
+
+func TestRecentOOMKill(t *testing.T) {
+	now := time.Now()
+	previousRun := now.Add(-time.Minute)
+
+	for _, tCase := range []struct {
+		state  docker.State
+		since  time.Time
+		killed bool
+	}{
+		{docker.State{Running: true}, previousRun, false},
+		{docker.State{Running: true, OOMKilled: true}, time.Time{}, true},
+		{docker.State{Restarting: true, OOMKilled: true}, previousRun, true},
+		{docker.State{OOMKilled: true, FinishedAt: now}, previousRun, true},
+		{docker.State{OOMKilled: true, FinishedAt: now}, time.Time{}, false},
+		{
+			docker.State{OOMKilled: true, FinishedAt: now.Add(-time.Hour)},
+			previousRun,
+			false,
+		},
+	} {
+		c := &docker.Container{State: tCase.state}
+
+		if killed := recentOOMKill(c, tCase.since); killed != tCase.killed {
+			t.Errorf("%+v: %v, expected %v", tCase.state, killed, tCase.killed)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_FILES_WARNING   = 80
+	DEFAULT_FILES_ERROR     = 90
+	DEFAULT_PIDS_WARNING    = 80
+	DEFAULT_PIDS_ERROR      = 90
+	DEFAULT_ENTROPY_WARNING = 200
+	DEFAULT_ENTROPY_ERROR   = 100
+)
+
+// readProcField reads the nth whitespace separated field of a /proc file.
+func readProcField(path string, n int) (float64, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(procRoot(), path))
+
+	if err != nil {
+		return 0.0, err
+	}
+
+	fields := strings.Fields(string(blob))
+
+	if len(fields) <= n {
+		return 0.0, fmt.Errorf("%s: malformed content %q", path, blob)
+	}
+
+	return strconv.ParseFloat(fields[n], 64)
+}
+
+func displayCount(unit string) func(float64) string {
+	return func(v float64) string { return fmt.Sprintf("%.0f %s", v, unit) }
+}
+
+var (
+	filesCheck = &Check{
+		Name: "files",
+		errorThreshold: fetchThreshold(
+			"FILES_ERROR",
+			percentage(DEFAULT_FILES_ERROR),
+		),
+		warningThreshold: fetchThreshold(
+			"FILES_WARNING",
+			percentage(DEFAULT_FILES_WARNING),
+		),
+		displayValue: displayCount("open files"),
+		fetchValue: func() (float64, error) {
+			// file-nr is "<allocated> <unused> <max>"
+			allocated, err := readProcField("sys/fs/file-nr", 0)
+
+			if err != nil {
+				return 0.0, err
+			}
+
+			unused, err := readProcField("sys/fs/file-nr", 1)
+
+			if err != nil {
+				return 0.0, err
+			}
+
+			return allocated - unused, nil
+		},
+		fetchTotal: func() (float64, error) {
+			return readProcField("sys/fs/file-max", 0)
+		},
+	}
+
+	pidsCheck = &Check{
+		Name: "pids",
+		errorThreshold: fetchThreshold(
+			"PIDS_ERROR",
+			percentage(DEFAULT_PIDS_ERROR),
+		),
+		warningThreshold: fetchThreshold(
+			"PIDS_WARNING",
+			percentage(DEFAULT_PIDS_WARNING),
+		),
+		displayValue: displayCount("threads"),
+		fetchValue: func() (float64, error) {
+			// the 4th field of loadavg is "<runnable>/<total>" threads
+			blob, err := ioutil.ReadFile(filepath.Join(procRoot(), "loadavg"))
+
+			if err != nil {
+				return 0.0, err
+			}
+
+			fields := strings.Fields(string(blob))
+
+			if len(fields) < 4 || !strings.Contains(fields[3], "/") {
+				return 0.0, fmt.Errorf("loadavg: malformed content %q", blob)
+			}
+
+			return strconv.ParseFloat(strings.SplitN(fields[3], "/", 2)[1], 64)
+		},
+		fetchTotal: func() (float64, error) {
+			return readProcField("sys/kernel/pid_max", 0)
+		},
+	}
+
+	entropyCheck = &Check{
+		Name: "entropy",
+		errorThreshold: fetchThreshold(
+			"ENTROPY_ERROR",
+			absolute(DEFAULT_ENTROPY_ERROR),
+		),
+		warningThreshold: fetchThreshold(
+			"ENTROPY_WARNING",
+			absolute(DEFAULT_ENTROPY_WARNING),
+		),
+		displayValue: displayCount("bits"),
+		below:        true,
+		fetchValue: func() (float64, error) {
+			return readProcField("sys/kernel/random/entropy_avail", 0)
+		},
+	}
+)
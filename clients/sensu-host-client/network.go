@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/upfluence/sensu-client-go/sensu/check"
+	"github.com/upfluence/sensu-client-go/sensu/handler"
+)
+
+const (
+	DEFAULT_PROC_ROOT         = "/proc"
+	DEFAULT_CONNTRACK_WARNING = 75
+	DEFAULT_CONNTRACK_ERROR   = 90
+)
+
+var tcpStates = map[string]string{
+	"01": "established",
+	"02": "syn_sent",
+	"03": "syn_recv",
+	"04": "fin_wait1",
+	"05": "fin_wait2",
+	"06": "time_wait",
+	"07": "close",
+	"08": "close_wait",
+	"09": "last_ack",
+	"0A": "listen",
+	"0B": "closing",
+}
+
+func procRoot() string {
+	if root := os.Getenv("PROC_ROOT"); root != "" {
+		return root
+	}
+
+	return DEFAULT_PROC_ROOT
+}
+
+type interfaceStats struct {
+	rxBytes, rxPackets, rxErrors, rxDrops float64
+	txBytes, txPackets, txErrors, txDrops float64
+}
+
+// readNetDev parses a /proc/net/dev formatted file, indexed by interface
+// name.
+func readNetDev(path string) (map[string]*interfaceStats, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	result := make(map[string]*interfaceStats)
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+
+		// The two first lines are headers
+		if len(parts) != 2 {
+			continue
+		}
+
+		fields := strings.Fields(parts[1])
+
+		if len(fields) < 16 {
+			return nil, fmt.Errorf("%s: malformed line %q", path, scanner.Text())
+		}
+
+		values := make([]float64, 16)
+
+		for i := range values {
+			if values[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+				return nil, err
+			}
+		}
+
+		result[strings.TrimSpace(parts[0])] = &interfaceStats{
+			rxBytes:   values[0],
+			rxPackets: values[1],
+			rxErrors:  values[2],
+			rxDrops:   values[3],
+			txBytes:   values[8],
+			txPackets: values[9],
+			txErrors:  values[10],
+			txDrops:   values[11],
+		}
+	}
+
+	return result, scanner.Err()
+}
+
+// readSnmp parses a /proc/net/snmp formatted file, made of pairs of header
+// and values lines, indexed by protocol and field.
+func readSnmp(path string) (map[string]map[string]float64, error) {
+	blob, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]map[string]float64)
+	lines := strings.Split(strings.TrimSpace(string(blob)), "\n")
+
+	for i := 0; i+1 < len(lines); i += 2 {
+		headers, values := strings.Fields(lines[i]), strings.Fields(lines[i+1])
+
+		if len(headers) != len(values) || len(headers) == 0 {
+			return nil, fmt.Errorf("%s: malformed line %q", path, lines[i])
+		}
+
+		protocol := strings.TrimSuffix(headers[0], ":")
+		result[protocol] = make(map[string]float64)
+
+		for j := 1; j < len(headers); j++ {
+			if v, err := strconv.ParseFloat(values[j], 64); err == nil {
+				result[protocol][headers[j]] = v
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// countTCPStates counts the sockets of /proc/net/tcp formatted files per
+// state.
+func countTCPStates(paths ...string) (map[string]float64, error) {
+	result := make(map[string]float64)
+
+	for _, state := range tcpStates {
+		result[state] = 0
+	}
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+
+			if len(fields) < 4 {
+				continue
+			}
+
+			if state, ok := tcpStates[fields[3]]; ok {
+				result[state]++
+			}
+		}
+
+		err = scanner.Err()
+		f.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+func HostNetworkMetric() check.ExtensionCheckResult {
+	metric := &handler.Metric{}
+	hostname := os.Getenv("SENSU_HOSTNAME")
+
+	if interfaces, err := readNetDev(
+		filepath.Join(procRoot(), "net", "dev"),
+	); err != nil {
+		log.Println(err.Error())
+	} else {
+		for name, stats := range interfaces {
+			name = strings.Replace(name, ".", "_", -1)
+
+			for k, v := range map[string]float64{
+				"rx_bytes":   stats.rxBytes,
+				"rx_packets": stats.rxPackets,
+				"rx_errors":  stats.rxErrors,
+				"rx_drops":   stats.rxDrops,
+				"tx_bytes":   stats.txBytes,
+				"tx_packets": stats.txPackets,
+				"tx_errors":  stats.txErrors,
+				"tx_drops":   stats.txDrops,
+			} {
+				metric.AddPoint(
+					&handler.Point{
+						fmt.Sprintf("%s.network.%s.%s", hostname, name, k),
+						v,
+					},
+				)
+			}
+		}
+	}
+
+	if snmp, err := readSnmp(filepath.Join(procRoot(), "net", "snmp")); err != nil {
+		log.Println(err.Error())
+	} else {
+		for _, k := range []string{"RetransSegs", "InErrs", "OutRsts"} {
+			if v, ok := snmp["Tcp"][k]; ok {
+				metric.AddPoint(
+					&handler.Point{
+						fmt.Sprintf("%s.tcp.%s", hostname, strings.ToLower(k)),
+						v,
+					},
+				)
+			}
+		}
+	}
+
+	if states, err := countTCPStates(
+		filepath.Join(procRoot(), "net", "tcp"),
+		filepath.Join(procRoot(), "net", "tcp6"),
+	); err != nil {
+		log.Println(err.Error())
+	} else {
+		for state, v := range states {
+			metric.AddPoint(
+				&handler.Point{
+					fmt.Sprintf("%s.tcp.states.%s", hostname, state),
+					v,
+				},
+			)
+		}
+	}
+
+	return metric.Render()
+}
+
+// readProcValue reads a single value file of /proc/sys, a missing file reads
+// as 0 so that hosts without the matching kernel module are left alone.
+func readProcValue(path string) (float64, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(procRoot(), path))
+
+	if os.IsNotExist(err) {
+		return 0.0, nil
+	} else if err != nil {
+		return 0.0, err
+	}
+
+	return strconv.ParseFloat(strings.TrimSpace(string(blob)), 64)
+}
+
+var conntrackCheck = &Check{
+	Name: "conntrack",
+	errorThreshold: fetchThreshold(
+		"CONNTRACK_ERROR",
+		percentage(DEFAULT_CONNTRACK_ERROR),
+	),
+	warningThreshold: fetchThreshold(
+		"CONNTRACK_WARNING",
+		percentage(DEFAULT_CONNTRACK_WARNING),
+	),
+	displayValue: func(v float64) string { return fmt.Sprintf("%.0f entries", v) },
+	fetchValue: func() (float64, error) {
+		return readProcValue("sys/net/netfilter/nf_conntrack_count")
+	},
+	fetchTotal: func() (float64, error) {
+		return readProcValue("sys/net/netfilter/nf_conntrack_max")
+	},
+}
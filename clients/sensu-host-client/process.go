@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry/bytefmt"
+	"github.com/upfluence/sensu-client-go/sensu/check"
+	"github.com/upfluence/sensu-client-go/sensu/handler"
+)
+
+const (
+	DEFAULT_PROCESS_TARGETS     = "docker,containerd,etcd,fleet"
+	DEFAULT_PROCESS_RSS_WARNING = 1500 * bytefmt.MEGABYTE
+	DEFAULT_PROCESS_RSS_ERROR   = 2000 * bytefmt.MEGABYTE
+	DEFAULT_PROCESS_FDS_WARNING = 80
+	DEFAULT_PROCESS_FDS_ERROR   = 90
+)
+
+// processTarget describes how to find a daemon of the host: through its
+// pidfile first, then among the processes named after one of its
+// executables, preferring the ones running in its systemd units.
+type processTarget struct {
+	name     string
+	pidFiles []string
+	units    []string
+	exes     []string
+
+	// pid is the last process found, reused as long as it runs
+	mu  sync.Mutex
+	pid int
+}
+
+var processTargets = []*processTarget{
+	{
+		name:     "docker",
+		pidFiles: []string{"/var/run/docker.pid"},
+		units:    []string{"docker.service"},
+		exes:     []string{"dockerd", "docker"},
+	},
+	{
+		name: "containerd",
+		pidFiles: []string{
+			"/var/run/docker/libcontainerd/docker-containerd.pid",
+		},
+		units: []string{"containerd.service", "docker.service"},
+		exes:  []string{"docker-containerd", "containerd"},
+	},
+	{
+		name:  "etcd",
+		units: []string{"etcd-member.service", "etcd2.service", "etcd.service"},
+		exes:  []string{"etcd", "etcd2"},
+	},
+	{
+		name:  "fleet",
+		units: []string{"fleet.service"},
+		exes:  []string{"fleetd", "fleet"},
+	},
+}
+
+func processTargetByName(name string) *processTarget {
+	for _, t := range processTargets {
+		if t.name == name {
+			return t
+		}
+	}
+
+	return nil
+}
+
+func readPidFile(path string) (int, error) {
+	blob, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(blob)))
+
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := os.Stat(filepath.Join(procRoot(), strconv.Itoa(pid))); err != nil {
+		return 0, err
+	}
+
+	return pid, nil
+}
+
+func listPids() ([]int, error) {
+	entries, err := ioutil.ReadDir(procRoot())
+
+	if err != nil {
+		return nil, err
+	}
+
+	pids := []int{}
+
+	for _, e := range entries {
+		if pid, err := strconv.Atoi(e.Name()); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+
+	sort.Ints(pids)
+
+	return pids, nil
+}
+
+// processName returns the name of the executable of a process. comm is
+// truncated to 15 characters, the name is read from the exe link instead, or
+// from argv[0] when the link can not be read.
+func processName(pid int) (string, error) {
+	dir := filepath.Join(procRoot(), strconv.Itoa(pid))
+
+	if exe, err := os.Readlink(filepath.Join(dir, "exe")); err == nil {
+		return filepath.Base(strings.TrimSuffix(exe, " (deleted)")), nil
+	}
+
+	blob, err := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+
+	if err != nil {
+		return "", err
+	}
+
+	argv0 := strings.SplitN(string(blob), "\x00", 2)[0]
+
+	if argv0 == "" {
+		return "", fmt.Errorf("%d: no executable", pid)
+	}
+
+	return filepath.Base(argv0), nil
+}
+
+// processUnit returns the systemd unit of a process out of its cgroup path,
+// such as "1:name=systemd:/system.slice/docker.service".
+func processUnit(pid int) (string, error) {
+	blob, err := ioutil.ReadFile(
+		filepath.Join(procRoot(), strconv.Itoa(pid), "cgroup"),
+	)
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(blob), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+
+		if len(parts) != 3 || (parts[1] != "name=systemd" && parts[1] != "") {
+			continue
+		}
+
+		return filepath.Base(parts[2]), nil
+	}
+
+	return "", nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// running returns whether a previously found process still runs the target.
+func (t *processTarget) running(pid int) bool {
+	name, err := processName(pid)
+
+	return err == nil && contains(t.exes, name)
+}
+
+func (t *processTarget) find() (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pid != 0 && t.running(t.pid) {
+		return t.pid, nil
+	}
+
+	pid, err := t.scan()
+
+	if err != nil {
+		t.pid = 0
+		return 0, err
+	}
+
+	t.pid = pid
+
+	return pid, nil
+}
+
+func (t *processTarget) scan() (int, error) {
+	for _, path := range t.pidFiles {
+		if pid, err := readPidFile(path); err == nil {
+			return pid, nil
+		}
+	}
+
+	pids, err := listPids()
+
+	if err != nil {
+		return 0, err
+	}
+
+	candidates := []int{}
+
+	for _, pid := range pids {
+		if name, err := processName(pid); err == nil && contains(t.exes, name) {
+			candidates = append(candidates, pid)
+		}
+	}
+
+	for _, pid := range candidates {
+		if unit, err := processUnit(pid); err == nil && contains(t.units, unit) {
+			return pid, nil
+		}
+	}
+
+	if len(candidates) > 0 {
+		return candidates[0], nil
+	}
+
+	return 0, fmt.Errorf("%s: process not found", t.name)
+}
+
+type processStats struct {
+	rss, vsz, threads, fds, maxFds float64
+}
+
+func readProcessStats(pid int) (*processStats, error) {
+	dir := filepath.Join(procRoot(), strconv.Itoa(pid))
+	stats := &processStats{}
+
+	f, err := os.Open(filepath.Join(dir, "status"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) < 2 {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(fields[1], 64)
+
+		if err != nil {
+			continue
+		}
+
+		switch fields[0] {
+		case "VmRSS:":
+			stats.rss = v * bytefmt.KILOBYTE
+		case "VmSize:":
+			stats.vsz = v * bytefmt.KILOBYTE
+		case "Threads:":
+			stats.threads = v
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	fds, err := ioutil.ReadDir(filepath.Join(dir, "fd"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	stats.fds = float64(len(fds))
+
+	limits, err := ioutil.ReadFile(filepath.Join(dir, "limits"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(limits), "\n") {
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, "Max open files"))
+
+		if len(fields) > 0 {
+			stats.maxFds, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+
+	return stats, nil
+}
+
+func (t *processTarget) stats() (*processStats, error) {
+	pid, err := t.find()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return readProcessStats(pid)
+}
+
+func (t *processTarget) checks() checkGroup {
+	key := strings.ToUpper(t.name)
+
+	return checkGroup{
+		&Check{
+			Name: fmt.Sprintf("process.%s.rss", t.name),
+			errorThreshold: fetchThreshold(
+				fmt.Sprintf("%s_RSS_ERROR", key),
+				absolute(DEFAULT_PROCESS_RSS_ERROR),
+			),
+			warningThreshold: fetchThreshold(
+				fmt.Sprintf("%s_RSS_WARNING", key),
+				absolute(DEFAULT_PROCESS_RSS_WARNING),
+			),
+			displayValue: displayBytes,
+			fetchValue: func() (float64, error) {
+				s, err := t.stats()
+
+				if err != nil {
+					return 0.0, err
+				}
+
+				return s.rss, nil
+			},
+		},
+		&Check{
+			Name: fmt.Sprintf("process.%s.fds", t.name),
+			errorThreshold: fetchThreshold(
+				fmt.Sprintf("%s_FDS_ERROR", key),
+				percentage(DEFAULT_PROCESS_FDS_ERROR),
+			),
+			warningThreshold: fetchThreshold(
+				fmt.Sprintf("%s_FDS_WARNING", key),
+				percentage(DEFAULT_PROCESS_FDS_WARNING),
+			),
+			displayValue: func(v float64) string { return fmt.Sprintf("%.0f fds", v) },
+			fetchValue: func() (float64, error) {
+				s, err := t.stats()
+
+				if err != nil {
+					return 0.0, err
+				}
+
+				return s.fds, nil
+			},
+			fetchTotal: func() (float64, error) {
+				s, err := t.stats()
+
+				if err != nil {
+					return 0.0, err
+				}
+
+				return s.maxFds, nil
+			},
+		},
+	}
+}
+
+func (t *processTarget) points() ([]*handler.Point, error) {
+	s, err := t.stats()
+
+	if err != nil {
+		return nil, err
+	}
+
+	points := []*handler.Point{}
+
+	for name, v := range map[string]float64{
+		"rss":     s.rss,
+		"vsz":     s.vsz,
+		"threads": s.threads,
+		"fds":     s.fds,
+	} {
+		points = append(
+			points,
+			&handler.Point{
+				fmt.Sprintf(
+					"%s.process.%s.%s",
+					os.Getenv("SENSU_HOSTNAME"),
+					t.name,
+					name,
+				),
+				v,
+			},
+		)
+	}
+
+	return points, nil
+}
+
+func (t *processTarget) Metric() check.ExtensionCheckResult {
+	return processMetric([]*processTarget{t})
+}
+
+func processMetric(targets []*processTarget) check.ExtensionCheckResult {
+	metric := &handler.Metric{}
+
+	for _, t := range targets {
+		points, err := t.points()
+
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		for _, p := range points {
+			metric.AddPoint(p)
+		}
+	}
+
+	return metric.Render()
+}
+
+// enabledProcessTargets returns the targets listed in PROCESS_TARGETS.
+func enabledProcessTargets() []*processTarget {
+	names := os.Getenv("PROCESS_TARGETS")
+
+	if names == "" {
+		names = DEFAULT_PROCESS_TARGETS
+	}
+
+	targets := []*processTarget{}
+
+	for _, name := range strings.Split(names, ",") {
+		if t := processTargetByName(strings.TrimSpace(name)); t != nil {
+			targets = append(targets, t)
+		} else {
+			log.Printf("Unknown process target: %s", name)
+		}
+	}
+
+	return targets
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/upfluence/sensu-client-go/sensu/check"
+	"github.com/upfluence/sensu-client-go/sensu/handler"
+)
+
+const (
+	DEFAULT_SYSTEMD_BLACKLIST        = ".+-backup\\..+"
+	DEFAULT_SYSTEMD_RESTARTS_WARNING = 3
+	DEFAULT_SYSTEMCTL                = "systemctl"
+	systemdRestartWindow             = time.Hour
+)
+
+type systemdUnit struct {
+	name        string
+	activeState string
+	subState    string
+	// restarts is the NRestarts property, -1 on systemd versions without it
+	restarts int
+}
+
+type systemdClient interface {
+	Units() ([]*systemdUnit, error)
+}
+
+// systemctlClient reads the units through the systemctl command, SYSTEMCTL
+// may wrap it, for instance into nsenter when the client runs in a container.
+type systemctlClient struct {
+	command []string
+}
+
+func newSystemctlClient() *systemctlClient {
+	command := os.Getenv("SYSTEMCTL")
+
+	if command == "" {
+		command = DEFAULT_SYSTEMCTL
+	}
+
+	return &systemctlClient{command: strings.Fields(command)}
+}
+
+func (c *systemctlClient) run(args ...string) ([]byte, error) {
+	args = append(append([]string{}, c.command[1:]...), args...)
+
+	out, err := exec.Command(c.command[0], args...).Output()
+
+	if err != nil {
+		return nil, fmt.Errorf("systemctl %s: %s", args[0], err.Error())
+	}
+
+	return out, nil
+}
+
+func (c *systemctlClient) Units() ([]*systemdUnit, error) {
+	out, err := c.run(
+		"list-units",
+		"--type=service",
+		"--all",
+		"--no-legend",
+		"--no-pager",
+		"--plain",
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		// Failed units may be prefixed by a bullet
+		fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(line), "●"))
+
+		if len(fields) > 0 {
+			names = append(names, fields[0])
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	out, err = c.run(
+		append(
+			[]string{
+				"show",
+				"--property=Id,ActiveState,SubState,NRestarts",
+			},
+			names...,
+		)...,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSystemctlShow(out), nil
+}
+
+// parseSystemctlShow reads the "Key=Value" blocks, one per unit separated by
+// empty lines, printed by systemctl show.
+func parseSystemctlShow(out []byte) []*systemdUnit {
+	units := []*systemdUnit{}
+	unit := &systemdUnit{restarts: -1}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			if unit.name != "" {
+				units = append(units, unit)
+			}
+
+			unit = &systemdUnit{restarts: -1}
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "Id":
+			unit.name = kv[1]
+		case "ActiveState":
+			unit.activeState = kv[1]
+		case "SubState":
+			unit.subState = kv[1]
+		case "NRestarts":
+			if v, err := strconv.Atoi(kv[1]); err == nil {
+				unit.restarts = v
+			}
+		}
+	}
+
+	if unit.name != "" {
+		units = append(units, unit)
+	}
+
+	return units
+}
+
+// systemdRestarts keeps the restarts observed over the last
+// systemdRestartWindow, by unit. Only the automatic restarts counted by
+// NRestarts are recorded, activations of timer and socket units are not
+// restarts.
+type systemdRestarts struct {
+	sync.Mutex
+	previous map[string]*systemdUnit
+	events   map[string][]time.Time
+}
+
+func (r *systemdRestarts) record(units []*systemdUnit, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	current := make(map[string]*systemdUnit)
+
+	for _, u := range units {
+		current[u.name] = u
+		p, ok := r.previous[u.name]
+
+		if !ok || u.restarts < 0 || p.restarts < 0 {
+			continue
+		}
+
+		for i := 0; i < u.restarts-p.restarts; i++ {
+			r.events[u.name] = append(r.events[u.name], now)
+		}
+	}
+
+	for name, events := range r.events {
+		recent := []time.Time{}
+
+		for _, t := range events {
+			if now.Sub(t) < systemdRestartWindow {
+				recent = append(recent, t)
+			}
+		}
+
+		if len(recent) == 0 {
+			delete(r.events, name)
+		} else {
+			r.events[name] = recent
+		}
+	}
+
+	r.previous = current
+}
+
+func (r *systemdRestarts) count(name string) int {
+	r.Lock()
+	defer r.Unlock()
+
+	return len(r.events[name])
+}
+
+var (
+	systemd                systemdClient = newSystemctlClient()
+	systemdRestartsHistory               = &systemdRestarts{
+		events: make(map[string][]time.Time),
+	}
+	systemdRestartsThreshold = fetchThreshold(
+		"SYSTEMD_RESTARTS_WARNING",
+		absolute(DEFAULT_SYSTEMD_RESTARTS_WARNING),
+	)
+)
+
+// SystemdCheck reports the failed units of the host, and the units restarted
+// too often over the last systemdRestartWindow. Restarts are not checked on
+// systemd versions without NRestarts.
+func SystemdCheck() check.ExtensionCheckResult {
+	units, err := systemd.Units()
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	blackListRegexp := DEFAULT_SYSTEMD_BLACKLIST
+
+	if v := os.Getenv("BLACKLIST_REGEXP"); v != "" {
+		blackListRegexp = v
+	}
+
+	reg, err := regexp.Compile(blackListRegexp)
+
+	if err != nil {
+		return handler.Error(err.Error())
+	}
+
+	systemdRestartsHistory.record(units, time.Now())
+
+	failedUnits := []string{}
+	restartingUnits := []string{}
+	maxRestarts := int(systemdRestartsThreshold.get().value)
+
+	for _, u := range units {
+		if reg.MatchString(u.name) {
+			continue
+		}
+
+		if u.activeState == "failed" || u.subState == "failed" {
+			failedUnits = append(failedUnits, u.name)
+		}
+
+		if n := systemdRestartsHistory.count(u.name); n > maxRestarts {
+			restartingUnits = append(
+				restartingUnits,
+				fmt.Sprintf("%s (%d restarts)", u.name, n),
+			)
+		}
+	}
+
+	sort.Strings(failedUnits)
+	sort.Strings(restartingUnits)
+
+	messages := []string{}
+
+	if len(failedUnits) > 0 {
+		messages = append(
+			messages,
+			fmt.Sprintf("Failed units: %s", strings.Join(failedUnits, ",")),
+		)
+	}
+
+	if len(restartingUnits) > 0 {
+		messages = append(
+			messages,
+			fmt.Sprintf(
+				"Units restarted more than %d times in %s: %s",
+				maxRestarts,
+				systemdRestartWindow,
+				strings.Join(restartingUnits, ","),
+			),
+		)
+	}
+
+	switch {
+	case len(failedUnits) > 0:
+		return handler.Error(strings.Join(messages, "; "))
+	case len(restartingUnits) > 0:
+		return handler.Warning(strings.Join(messages, "; "))
+	default:
+		return handler.Ok("Every units are up and running")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/upfluence/sensu-client-go/sensu/check"
+)
+
+// fakeSystemd returns its runs of units one after the other, the last one
+// once exhausted.
+type fakeSystemd struct {
+	runs [][]*systemdUnit
+}
+
+func (f *fakeSystemd) Units() ([]*systemdUnit, error) {
+	units := f.runs[0]
+
+	if len(f.runs) > 1 {
+		f.runs = f.runs[1:]
+	}
+
+	return units, nil
+}
+
+func runSystemdCheck(runs [][]*systemdUnit) check.ExtensionCheckResult {
+	previousClient, previousHistory := systemd, systemdRestartsHistory
+	defer func() { systemd, systemdRestartsHistory = previousClient, previousHistory }()
+
+	systemd = &fakeSystemd{runs: runs}
+	systemdRestartsHistory = &systemdRestarts{
+		events: make(map[string][]time.Time),
+	}
+
+	var result check.ExtensionCheckResult
+
+	for range runs {
+		result = SystemdCheck()
+	}
+
+	return result
+}
+
+func TestSystemdCheckRestarts(t *testing.T) {
+	result := runSystemdCheck(
+		[][]*systemdUnit{
+			{
+				{name: "api.service", activeState: "active", restarts: 0},
+				{name: "etcd.service", activeState: "active", restarts: 2},
+			},
+			{
+				{name: "api.service", activeState: "active", restarts: 5},
+				{name: "etcd.service", activeState: "active", restarts: 3},
+			},
+		},
+	)
+
+	if result.Status != check.Warning {
+		t.Errorf("status %d: %s", result.Status, result.Output)
+	}
+
+	if !strings.Contains(result.Output, "api.service (5 restarts)") ||
+		strings.Contains(result.Output, "etcd.service") {
+		t.Errorf("unexpected output: %s", result.Output)
+	}
+}
+
+func TestSystemdCheckWithoutNRestarts(t *testing.T) {
+	result := runSystemdCheck(
+		[][]*systemdUnit{
+			{
+				{name: "backup.timer", activeState: "active", restarts: -1},
+				{name: "docker.service", activeState: "failed", restarts: -1},
+			},
+			{
+				{name: "backup.timer", activeState: "active", restarts: -1},
+				{name: "docker.service", activeState: "failed", restarts: -1},
+			},
+		},
+	)
+
+	if result.Status != check.Error {
+		t.Errorf("status %d: %s", result.Status, result.Output)
+	}
+
+	if result.Output != "Failed units: docker.service" {
+		t.Errorf("unexpected output: %s", result.Output)
+	}
+}
+
+func TestParseSystemctlShow(t *testing.T) {
+	units := parseSystemctlShow(
+		[]byte(
+			"Id=api.service\nActiveState=active\nSubState=running\nNRestarts=4\n\n" +
+				"Id=etcd.service\nActiveState=failed\nSubState=failed\n",
+		),
+	)
+
+	if len(units) != 2 {
+		t.Fatalf("%d units, expected 2", len(units))
+	}
+
+	if *units[0] != (systemdUnit{"api.service", "active", "running", 4}) {
+		t.Errorf("%+v", *units[0])
+	}
+
+	if *units[1] != (systemdUnit{"etcd.service", "failed", "failed", -1}) {
+		t.Errorf("%+v", *units[1])
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bytefmt"
+	"github.com/coreos/go-etcd/etcd"
+)
+
+const (
+	hostKeysPrefix     = "/sensu/host"
+	fleetKeyPrefix     = "/_coreos.com/fleet/"
+	machineIDPath      = "/etc/machine-id"
+	builtinLevel       = "builtin"
+	etcdKeyNotFound    = 100
+	watchRetryInterval = 10 * time.Second
+)
+
+type threshold struct {
+	value      float64
+	percentage bool
+	// level is the place of the hierarchy where the threshold has been found
+	level string
+}
+
+func absolute(v float64) threshold {
+	return threshold{value: v}
+}
+
+func percentage(v float64) threshold {
+	return threshold{value: v, percentage: true}
+}
+
+func (t threshold) limit(total float64) float64 {
+	if t.percentage {
+		return total * t.value / 100.0
+	}
+
+	return t.value
+}
+
+func (t threshold) String() string {
+	if t.percentage {
+		return fmt.Sprintf("%g%%", t.value)
+	}
+
+	return bytefmt.ByteSize(uint64(t.value))
+}
+
+var sizePattern = regexp.MustCompile(`(?i)^(\d+(?:\.\d+)?)\s*([KMGT])?B?$`)
+
+// parseSize is a more lenient bytefmt.ToBytes, it accepts decimal values
+// ("3.7G") and unit-less numbers.
+func parseSize(value string) (float64, error) {
+	matches := sizePattern.FindStringSubmatch(value)
+
+	if matches == nil {
+		return 0.0, fmt.Errorf("Invalid size: %q", value)
+	}
+
+	size, err := strconv.ParseFloat(matches[1], 64)
+
+	if err != nil {
+		return 0.0, err
+	}
+
+	switch strings.ToUpper(matches[2]) {
+	case "T":
+		size *= bytefmt.TERABYTE
+	case "G":
+		size *= bytefmt.GIGABYTE
+	case "M":
+		size *= bytefmt.MEGABYTE
+	case "K":
+		size *= bytefmt.KILOBYTE
+	}
+
+	return size, nil
+}
+
+// parseThreshold reads either a size ("3.7G") or a percentage of the checked
+// resource total ("85%").
+func parseThreshold(value string) (threshold, error) {
+	value = strings.TrimSpace(value)
+
+	if strings.HasSuffix(value, "%") {
+		v, err := strconv.ParseFloat(
+			strings.TrimSpace(strings.TrimSuffix(value, "%")),
+			64,
+		)
+
+		if err != nil {
+			return threshold{}, err
+		}
+
+		if v < 0 || v > 100 {
+			return threshold{}, fmt.Errorf("Invalid percentage: %q", value)
+		}
+
+		return percentage(v), nil
+	}
+
+	size, err := parseSize(value)
+
+	if err != nil {
+		return threshold{}, err
+	}
+
+	return absolute(size), nil
+}
+
+func etcdMachines() []string {
+	if os.Getenv("ETCD_URL") == "" {
+		return []string{"http://127.0.0.1:2379"}
+	}
+
+	return strings.Split(os.Getenv("ETCD_URL"), ",")
+}
+
+func hostKeyPrefix() string {
+	return fmt.Sprintf("%s/%s", hostKeysPrefix, os.Getenv("SENSU_HOSTNAME"))
+}
+
+var (
+	roleOnce sync.Once
+	role     string
+)
+
+// machineRole returns the role of the host, either given through SENSU_ROLE
+// or read from the fleet machine metadata.
+func machineRole() string {
+	roleOnce.Do(func() {
+		if role = os.Getenv("SENSU_ROLE"); role != "" {
+			return
+		}
+
+		blob, err := ioutil.ReadFile(machineIDPath)
+
+		if err != nil {
+			log.Printf("role: %s", err.Error())
+			return
+		}
+
+		resp, err := etcd.NewClient(etcdMachines()).Get(
+			fmt.Sprintf(
+				"%smachines/%s/object",
+				fleetKeyPrefix,
+				strings.TrimSpace(string(blob)),
+			),
+			false,
+			false,
+		)
+
+		if err != nil {
+			log.Printf("role: %s", err.Error())
+			return
+		}
+
+		var machine struct {
+			Metadata map[string]string
+		}
+
+		if err := json.Unmarshal([]byte(resp.Node.Value), &machine); err != nil {
+			log.Printf("role: %s", err.Error())
+			return
+		}
+
+		role = machine.Metadata["role"]
+	})
+
+	return role
+}
+
+type thresholdLevel struct {
+	name   string
+	prefix string
+}
+
+// thresholdLevels lists where thresholds are looked up, by order of
+// precedence.
+func thresholdLevels() []thresholdLevel {
+	levels := []thresholdLevel{{"host", hostKeyPrefix()}}
+
+	if r := machineRole(); r != "" {
+		levels = append(
+			levels,
+			thresholdLevel{
+				fmt.Sprintf("role %s", r),
+				fmt.Sprintf("%s/_roles/%s", hostKeysPrefix, r),
+			},
+		)
+	}
+
+	return append(levels, thresholdLevel{"default", hostKeysPrefix + "/_default"})
+}
+
+func isKeyNotFound(err error) bool {
+	etcdErr, ok := err.(*etcd.EtcdError)
+
+	return ok && etcdErr.ErrorCode == etcdKeyNotFound
+}
+
+// getLevelKey reads a host setting at one level of the hierarchy.
+func getLevelKey(
+	client *etcd.Client,
+	level thresholdLevel,
+	key string,
+) (string, bool) {
+	resp, err := client.Get(
+		fmt.Sprintf("%s/%s", level.prefix, key),
+		false,
+		false,
+	)
+
+	if err != nil {
+		if !isKeyNotFound(err) {
+			log.Printf(
+				"%s: %s (%s): %s",
+				os.Getenv("SENSU_HOSTNAME"),
+				key,
+				level.name,
+				err.Error(),
+			)
+		}
+
+		return "", false
+	}
+
+	// A directory holds the settings of children keys, not a value
+	if resp.Node.Dir {
+		return "", false
+	}
+
+	return resp.Node.Value, true
+}
+
+// lookupKey reads a host setting from the first level of the hierarchy
+// defining it.
+func lookupKey(client *etcd.Client, key string) (string, string, bool) {
+	for _, level := range thresholdLevels() {
+		if value, ok := getLevelKey(client, level, key); ok {
+			return value, level.name, true
+		}
+	}
+
+	return "", "", false
+}
+
+// loadThreshold reads a threshold from the first level of the hierarchy
+// defining a valid one, an unparsable value falls through to the next level.
+// Within a level the keys are tried in order.
+func loadThreshold(
+	client *etcd.Client,
+	keys []string,
+	defaultValue threshold,
+) threshold {
+	for _, level := range thresholdLevels() {
+		for _, key := range keys {
+			value, ok := getLevelKey(client, level, key)
+
+			if !ok {
+				continue
+			}
+
+			t, err := parseThreshold(value)
+
+			if err != nil {
+				log.Printf(
+					"%s: %s (%s): %s",
+					os.Getenv("SENSU_HOSTNAME"),
+					key,
+					level.name,
+					err.Error(),
+				)
+
+				continue
+			}
+
+			t.level = level.name
+
+			return t
+		}
+	}
+
+	return defaultValue
+}
+
+// liveThreshold is a threshold read from etcd and kept up to date by
+// watchThresholds, it can be read while being reloaded.
+type liveThreshold struct {
+	key string
+	// fallbackKeys are read when key is not set, e.g. legacy settings
+	fallbackKeys []string
+	defaultValue threshold
+
+	mu    sync.RWMutex
+	value threshold
+}
+
+func (l *liveThreshold) get() threshold {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.value
+}
+
+func (l *liveThreshold) reload(client *etcd.Client) {
+	t := loadThreshold(
+		client,
+		append([]string{l.key}, l.fallbackKeys...),
+		l.defaultValue,
+	)
+
+	l.mu.Lock()
+	previous := l.value
+	l.value = t
+	l.mu.Unlock()
+
+	if previous != t {
+		log.Printf(
+			"%s: %s: %s (%s) -> %s (%s)",
+			os.Getenv("SENSU_HOSTNAME"),
+			l.key,
+			previous,
+			previous.level,
+			t,
+			t.level,
+		)
+	}
+}
+
+// watches returns whether a change of the given etcd key may affect the
+// threshold.
+func (l *liveThreshold) watches(levels []thresholdLevel, key string) bool {
+	for _, level := range levels {
+		for _, k := range append([]string{l.key}, l.fallbackKeys...) {
+			k = fmt.Sprintf("%s/%s", level.prefix, k)
+
+			if k == key || strings.HasPrefix(k, key+"/") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+var liveThresholds = struct {
+	sync.Mutex
+	thresholds []*liveThreshold
+}{}
+
+func fetchThreshold(
+	key string,
+	defaultValue threshold,
+	fallbackKeys ...string,
+) *liveThreshold {
+	defaultValue.level = builtinLevel
+	l := &liveThreshold{
+		key:          key,
+		fallbackKeys: fallbackKeys,
+		defaultValue: defaultValue,
+		value:        defaultValue,
+	}
+	l.reload(etcd.NewClient(etcdMachines()))
+
+	liveThresholds.Lock()
+	liveThresholds.thresholds = append(liveThresholds.thresholds, l)
+	liveThresholds.Unlock()
+
+	return l
+}
+
+// reloadThresholds refreshes the thresholds stored under the given etcd key,
+// or all of them if the key is empty.
+func reloadThresholds(client *etcd.Client, key string) {
+	liveThresholds.Lock()
+	thresholds := liveThresholds.thresholds
+	liveThresholds.Unlock()
+
+	levels := thresholdLevels()
+
+	for _, l := range thresholds {
+		if key == "" || l.watches(levels, key) {
+			l.reload(client)
+		}
+	}
+}
+
+// syncThresholds reloads every threshold and returns the etcd index to watch
+// from so that no change made meanwhile is missed.
+func syncThresholds(client *etcd.Client) uint64 {
+	waitIndex := uint64(0)
+
+	resp, err := client.Get(hostKeysPrefix, false, false)
+
+	if err == nil {
+		waitIndex = resp.EtcdIndex + 1
+	} else if etcdErr, ok := err.(*etcd.EtcdError); ok {
+		waitIndex = etcdErr.Index + 1
+	} else {
+		log.Printf("%s: watch: %s", os.Getenv("SENSU_HOSTNAME"), err.Error())
+	}
+
+	reloadThresholds(client, "")
+
+	return waitIndex
+}
+
+// watchThresholds follows the changes made to the host, role and default keys
+// and reloads the affected thresholds, it never returns.
+func watchThresholds() {
+	client := etcd.NewClient(etcdMachines())
+	waitIndex := syncThresholds(client)
+
+	for {
+		resp, err := client.Watch(hostKeysPrefix, waitIndex, true, nil, nil)
+
+		if err != nil {
+			log.Printf("%s: watch: %s", os.Getenv("SENSU_HOSTNAME"), err.Error())
+
+			// Changes may have been missed meanwhile, start over from the
+			// current state
+			time.Sleep(watchRetryInterval)
+			waitIndex = syncThresholds(client)
+
+			continue
+		}
+
+		waitIndex = resp.Node.ModifiedIndex + 1
+		reloadThresholds(client, resp.Node.Key)
+	}
+}